@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ------- reloadable access lists -------
+
+// accessListSet is one snapshot of the identity gates. Handlers load it once
+// per check, so a reload never mixes old and new entries.
+type accessListSet struct {
+	allowedHD       string
+	denySubjects    map[string]bool
+	allowedSubjects map[string]bool
+	allowedEmails   map[string]bool // normalized with EMAIL_MATCH
+}
+
+// accessListFiles are the <VAR>_FILE variables behind an accessListSet.
+var accessListFiles = []string{"ALLOWED_HD_FILE", "DENY_SUBJECTS_FILE", "ALLOWED_SUBJECTS_FILE", "ALLOWED_EMAILS_FILE"}
+
+// readAccessLists reads ALLOWED_HD, DENY_SUBJECTS, ALLOWED_SUBJECTS and
+// ALLOWED_EMAILS, each merged with the file named by its <VAR>_FILE.
+func readAccessLists(e *envReader, emails emailMatch) accessListSet {
+	s := accessListSet{
+		allowedHD:       e.str("ALLOWED_HD", ""),
+		denySubjects:    e.fileSet("DENY_SUBJECTS"),
+		allowedSubjects: e.fileSet("ALLOWED_SUBJECTS"),
+		allowedEmails:   make(map[string]bool),
+	}
+	if path := e.str("ALLOWED_HD_FILE", ""); path != "" {
+		switch vals, err := readListFile(path); {
+		case err != nil:
+			e.fail("ALLOWED_HD_FILE: %v", err)
+		case len(vals) > 1:
+			e.fail("ALLOWED_HD_FILE: want one domain, got %d", len(vals))
+		case len(vals) == 1 && s.allowedHD != "" && s.allowedHD != vals[0]:
+			e.fail("ALLOWED_HD_FILE: %q conflicts with ALLOWED_HD %q", vals[0], s.allowedHD)
+		case len(vals) == 1:
+			s.allowedHD = vals[0]
+		}
+	}
+	for email := range e.fileSet("ALLOWED_EMAILS") {
+		s.allowedEmails[emails.normalize(email)] = true
+	}
+	return s
+}
+
+// Gates SHADOW_MODE can put in report-only mode; "true" means all of them.
+const (
+	gateDomain       = "domain"        // ALLOWED_HD
+	gateAllowlist    = "allowlist"     // ALLOWED_SUBJECTS / ALLOWED_EMAILS
+	gateDenySubjects = "deny_subjects" // DENY_SUBJECTS
+)
+
+func readShadowGates(e *envReader) map[string]bool {
+	gates := make(map[string]bool)
+	for _, g := range e.list("SHADOW_MODE") {
+		switch g = strings.ToLower(g); g {
+		case "true":
+			gates[gateDomain], gates[gateAllowlist], gates[gateDenySubjects] = true, true, true
+		case "false":
+		case gateDomain, gateAllowlist, gateDenySubjects:
+			gates[g] = true
+		default:
+			e.fail("SHADOW_MODE: unknown gate %q (want %s, %s, %s or true)", g, gateDomain, gateAllowlist, gateDenySubjects)
+		}
+	}
+	return gates
+}
+
+// accessLists serves the current accessListSet. The files behind it are
+// re-read on SIGHUP and, with ACCESS_LISTS_RELOAD_INTERVAL, whenever one of
+// them changes; a reload that fails keeps the previous lists in force.
+type accessLists struct {
+	emails emailMatch
+	set    atomic.Pointer[accessListSet]
+
+	mu     sync.Mutex // serializes reloads and guards stamps
+	stamps map[string]fileStamp
+}
+
+// fileStamp is what a periodic stat compares to notice an edited file.
+type fileStamp struct {
+	mod  time.Time
+	size int64
+}
+
+func newAccessLists(cfg Config) *accessLists {
+	a := &accessLists{emails: cfg.EmailMatch}
+	a.set.Store(&accessListSet{
+		allowedHD:       cfg.AllowedHD,
+		denySubjects:    cfg.DenySubjects,
+		allowedSubjects: cfg.AllowedSubjects,
+		allowedEmails:   cfg.AllowedEmails,
+	})
+	a.stamps = a.stat()
+	return a
+}
+
+func (a *accessLists) load() *accessListSet { return a.set.Load() }
+
+// files are the configured _FILE paths; none means nothing can change.
+func (a *accessLists) files() []string {
+	var out []string
+	for _, key := range accessListFiles {
+		if path := strings.TrimSpace(os.Getenv(key)); path != "" {
+			out = append(out, path)
+		}
+	}
+	return out
+}
+
+func (a *accessLists) stat() map[string]fileStamp {
+	out := make(map[string]fileStamp)
+	for _, path := range a.files() {
+		if fi, err := os.Stat(path); err == nil {
+			out[path] = fileStamp{mod: fi.ModTime(), size: fi.Size()}
+		}
+	}
+	return out
+}
+
+func (a *accessLists) reload() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.reloadLocked()
+}
+
+func (a *accessLists) reloadLocked() error {
+	a.stamps = a.stat()
+	var e envReader
+	s := readAccessLists(&e, a.emails)
+	if err := errors.Join(e.errs...); err != nil {
+		return err
+	}
+	a.set.Store(&s)
+	return nil
+}
+
+// watch stats the files every interval and reloads when one has changed.
+func (a *accessLists) watch(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		a.mu.Lock()
+		if changed := !stampsEqual(a.stamps, a.stat()); changed {
+			if err := a.reloadLocked(); err != nil {
+				log.Printf("reload access lists: %v", err)
+			} else {
+				log.Printf("reloaded access lists")
+			}
+		}
+		a.mu.Unlock()
+	}
+}
+
+func stampsEqual(a, b map[string]fileStamp) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for path, s := range a {
+		if t, ok := b[path]; !ok || !t.mod.Equal(s.mod) || t.size != s.size {
+			return false
+		}
+	}
+	return true
+}
+
+// wrongDomainMsg is the 403 message for a caller outside allowedHD.
+func (s *accessListSet) wrongDomainMsg(disclose bool) string {
+	if s.allowedHD != "" && disclose {
+		return fmt.Sprintf("forbidden: wrong domain; please sign in with an @%s account", s.allowedHD)
+	}
+	return "forbidden: wrong domain"
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAccessListsReload(t *testing.T) {
+	dir := t.TempDir()
+	subjects, hd := filepath.Join(dir, "subjects"), filepath.Join(dir, "hd")
+	write := func(path, body string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(body), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(subjects, "user-1\n")
+	write(hd, "example.com\n")
+
+	signer := newTestSigner(t, "k1")
+	cfg := testConfig(t, map[string]string{
+		"ALLOWED_SUBJECTS_FILE":        subjects,
+		"ALLOWED_HD_FILE":              hd,
+		"ACCESS_LISTS_RELOAD_INTERVAL": "10ms",
+	})
+	s := newTestServer(t, cfg, newFakeVerifier(signer), &fakeMinter{}, nil)
+	token := func() int {
+		req := httptest.NewRequest(http.MethodGet, "/token", nil)
+		req.Header.Set("Authorization", "Bearer "+signer.sign(t, idClaims(nil)))
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	waitFor := func(want int) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for token() != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("/token never returned %d after the file changed", want)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	if got := token(); got != http.StatusOK {
+		t.Fatalf("/token = %d for an allow-listed caller", got)
+	}
+	write(hd, "other.example\n")
+	waitFor(http.StatusForbidden)
+	write(hd, "example.com\n")
+	waitFor(http.StatusOK)
+
+	// revoking the subject takes effect without a restart
+	write(subjects, "someone-else\n")
+	waitFor(http.StatusForbidden)
+
+	// a broken file keeps the last good lists
+	write(hd, "a.example\nb.example\n")
+	time.Sleep(50 * time.Millisecond)
+	write(subjects, "user-1\n")
+	time.Sleep(50 * time.Millisecond)
+	if got := token(); got != http.StatusForbidden {
+		t.Errorf("/token = %d after a failed reload, want the previous lists (403)", got)
+	}
+}
+
+func TestShadowMode(t *testing.T) {
+	signer := newTestSigner(t, "k1")
+	valid := signer.sign(t, idClaims(nil)) // user-1 at example.com
+	strict := map[string]string{"ALLOWED_HD": "example.org", "ALLOWED_SUBJECTS": "someone-else", "DENY_SUBJECTS": "user-1"}
+	for _, tt := range []struct {
+		shadow     string
+		wantStatus int
+	}{
+		{"true", http.StatusOK},
+		{"deny_subjects,allowlist,domain", http.StatusOK},
+		{"deny_subjects,domain", http.StatusForbidden}, // the allow-list still enforces
+		{"", http.StatusForbidden},
+	} {
+		env := map[string]string{"SHADOW_MODE": tt.shadow}
+		for k, v := range strict {
+			env[k] = v
+		}
+		s := newTestServer(t, testConfig(t, env), newFakeVerifier(signer), &fakeMinter{}, nil)
+		req := httptest.NewRequest(http.MethodGet, "/token", nil)
+		req.Header.Set("Authorization", "Bearer "+valid)
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		if rec.Code != tt.wantStatus {
+			t.Errorf("SHADOW_MODE=%q: %d %s, want %d", tt.shadow, rec.Code, rec.Body, tt.wantStatus)
+		}
+	}
+
+	setTestEnv(t, map[string]string{"SHADOW_MODE": "geo"})
+	if _, err := loadConfig(); err == nil {
+		t.Error("SHADOW_MODE accepted an unknown gate")
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+)
+
+// ------- structured logging -------
+
+// newLogger builds the process logger: JSON lines on stderr at level. It is
+// installed as slog's default, which also routes log.Printf through it.
+func newLogger(level string) *slog.Logger {
+	var l slog.Level
+	_ = l.UnmarshalText([]byte(level))
+	return slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: l}))
+}
+
+// accessInfo collects what handlers learn about a request (the subject, once
+// verified) for the access log line written when it completes.
+type accessInfo struct {
+	subject string
+}
+
+type accessCtxKey struct{}
+
+func withAccessInfo(r *http.Request) (*http.Request, *accessInfo) {
+	info := &accessInfo{}
+	return r.WithContext(context.WithValue(r.Context(), accessCtxKey{}, info)), info
+}
+
+// setSubject records the authenticated subject for the access log.
+func setSubject(r *http.Request, sub string) {
+	if info, ok := r.Context().Value(accessCtxKey{}).(*accessInfo); ok {
+		info.subject = sub
+	}
+}
+
+// logAccess writes the one line per request. 5xx responses log at error.
+func logAccess(r *http.Request, ip string, info *accessInfo, status int, start time.Time) {
+	level := slog.LevelInfo
+	if status >= 500 {
+		level = slog.LevelError
+	}
+	attrs := []slog.Attr{
+		slog.String("request_id", requestIDOf(r.Context())),
+		slog.String("method", r.Method),
+		slog.String("path", r.URL.Path),
+		slog.String("ip", ip),
+		slog.Int("status", status),
+		slog.Float64("latency_ms", float64(time.Since(start).Microseconds())/1000),
+	}
+	if info.subject != "" {
+		attrs = append(attrs, slog.String("sub", info.subject))
+	}
+	slog.LogAttrs(r.Context(), level, "request", attrs...)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+)
+
+// ------- audit log -------
+type auditRecord struct {
+	Time           string `json:"time"`
+	Event          string `json:"event"`
+	Subject        string `json:"sub"`
+	Email          string `json:"email,omitempty"`
+	IP             string `json:"ip"`
+	Scope          string `json:"scope"`
+	Resource       string `json:"resource,omitempty"`
+	Audience       string `json:"audience,omitempty"`        // id_token_issued only
+	ServiceAccount string `json:"service_account,omitempty"` // set when SERVICE_ACCOUNTS_FILE picked one
+	ExpiresIn      int    `json:"expires_in"`
+	Fingerprint    string `json:"token_fingerprint"`
+}
+
+// auditLog appends JSON lines to a file from a single background writer so
+// slow disks never stall the request path. When the buffer is full, records
+// are dropped (and counted) unless block is set.
+type auditLog struct {
+	mu     sync.RWMutex
+	closed bool
+	ch     chan auditRecord
+	block  bool
+	f      *os.File
+	done   chan struct{}
+}
+
+func newAuditLog(path string, bufSize int, overflow string) (*auditLog, error) {
+	if overflow != "drop" && overflow != "block" {
+		return nil, fmt.Errorf("AUDIT_OVERFLOW must be drop or block, got %q", overflow)
+	}
+	if bufSize < 1 {
+		bufSize = 1
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	a := &auditLog{
+		ch:    make(chan auditRecord, bufSize),
+		block: overflow == "block",
+		f:     f,
+		done:  make(chan struct{}),
+	}
+	go a.run()
+	return a, nil
+}
+
+// write queues rec; it is a no-op on a nil or closed log.
+func (a *auditLog) write(rec auditRecord) {
+	if a == nil {
+		return
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if a.closed {
+		return
+	}
+	if a.block {
+		a.ch <- rec
+		return
+	}
+	select {
+	case a.ch <- rec:
+	default:
+		auditDropped.Inc()
+	}
+}
+
+func (a *auditLog) run() {
+	defer close(a.done)
+	bw := bufio.NewWriter(a.f)
+	enc := json.NewEncoder(bw)
+	for rec := range a.ch {
+		if err := enc.Encode(rec); err != nil {
+			log.Printf("audit write: %v", err)
+		}
+		// flush once the queue is drained so bursts share a syscall
+		if len(a.ch) == 0 {
+			if err := bw.Flush(); err != nil {
+				log.Printf("audit flush: %v", err)
+			}
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		log.Printf("audit flush: %v", err)
+	}
+}
+
+// close stops accepting records, drains the queue and syncs the file.
+func (a *auditLog) close() {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		return
+	}
+	a.closed = true
+	close(a.ch)
+	a.mu.Unlock()
+	<-a.done
+	_ = a.f.Sync()
+	_ = a.f.Close()
+}
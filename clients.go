@@ -0,0 +1,74 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// ------- client credentials -------
+
+// clientCredential is one entry of CLIENT_CREDENTIALS_FILE: a pre-shared
+// secret for a non-interactive client and the scopes it is minted.
+type clientCredential struct {
+	ClientID     string   `json:"client_id"`
+	ClientSecret string   `json:"client_secret"`
+	Scopes       []string `json:"scopes"`
+}
+
+type clientRegistry struct {
+	byID map[string]clientCredential
+}
+
+func loadClientRegistry(path string) (*clientRegistry, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var list []clientCredential
+	if err := json.Unmarshal(buf, &list); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	c := &clientRegistry{byID: make(map[string]clientCredential)}
+	for i, cred := range list {
+		switch {
+		case cred.ClientID == "":
+			return nil, fmt.Errorf("entry %d: client_id is required", i)
+		case cred.ClientSecret == "":
+			return nil, fmt.Errorf("client %q: client_secret is required", cred.ClientID)
+		case len(cred.Scopes) == 0:
+			return nil, fmt.Errorf("client %q: scopes are required", cred.ClientID)
+		}
+		if _, dup := c.byID[cred.ClientID]; dup {
+			return nil, fmt.Errorf("client %q listed twice", cred.ClientID)
+		}
+		c.byID[cred.ClientID] = cred
+	}
+	return c, nil
+}
+
+// authenticate returns the client for id when secret matches. Unknown ids
+// still pay for a comparison so timing does not reveal which ids exist.
+func (c *clientRegistry) authenticate(id, secret string) (clientCredential, bool) {
+	cred, ok := c.byID[id]
+	want := cred.ClientSecret
+	if !ok {
+		want = secret + "x"
+	}
+	if subtle.ConstantTimeCompare([]byte(secret), []byte(want)) != 1 || !ok {
+		return clientCredential{}, false
+	}
+	return cred, true
+}
+
+// clientCredentialsFrom reads client_id/client_secret from HTTP Basic auth
+// or, failing that, the form body (RFC 6749 §2.3.1).
+func clientCredentialsFrom(r *http.Request) (id, secret string, ok bool) {
+	if id, secret, ok = r.BasicAuth(); ok {
+		return id, secret, id != "" && secret != ""
+	}
+	id, secret = r.PostFormValue("client_id"), r.PostFormValue("client_secret")
+	return id, secret, id != "" && secret != ""
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestClientCredentials(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "clients.json")
+	if err := os.WriteFile(path, []byte(`[{"client_id":"batch-job","client_secret":"s3cret","scopes":["https://www.googleapis.com/auth/devstorage.read_only"]}]`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	minter := &recordingMinter{}
+	s := newTestServer(t, testConfig(t, map[string]string{"CLIENT_CREDENTIALS_FILE": path}), newFakeVerifier(newTestSigner(t, "k1")), minter, nil)
+	post := func(user, pass string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/token", strings.NewReader("grant_type=client_credentials"))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth(user, pass)
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := post("batch-job", "s3cret")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+	}
+	var resp tokenResp
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.AccessToken != "ya29.test" || resp.Scope != "https://www.googleapis.com/auth/devstorage.read_only" {
+		t.Errorf("got %+v", resp)
+	}
+	// the client's scopes are minted through the Minter
+	if want := [][]string{{"https://www.googleapis.com/auth/devstorage.read_only"}}; !reflect.DeepEqual(minter.scopes, want) {
+		t.Errorf("minted %q, want %q", minter.scopes, want)
+	}
+
+	if rec := post("batch-job", "wrong"); rec.Code != http.StatusUnauthorized || !strings.Contains(rec.Body.String(), `"code":"invalid_client"`) {
+		t.Errorf("wrong secret: %d %s, want 401 invalid_client", rec.Code, rec.Body)
+	}
+	if len(minter.scopes) != 1 {
+		t.Errorf("%d mints, want 1", len(minter.scopes))
+	}
+}
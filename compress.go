@@ -0,0 +1,137 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ------- response compression -------
+
+// compression negotiates Content-Encoding for response bodies of at least
+// min bytes. algos is the server's preference order.
+type compression struct {
+	min   int
+	algos []string
+}
+
+// newCompression validates COMPRESS_ALGOS. Brotli is accepted in the list but
+// needs an encoder this build doesn't link, so it is dropped with a warning;
+// nil means compression is off.
+func newCompression(algos []string, min int) (*compression, error) {
+	c := &compression{min: min}
+	for _, a := range algos {
+		switch a = strings.ToLower(a); a {
+		case "gzip":
+			c.algos = append(c.algos, a)
+		case "br":
+			log.Printf("WARNING: COMPRESS_ALGOS: br is not available in this build; skipping it")
+		default:
+			return nil, fmt.Errorf("unknown algorithm %q (want gzip or br)", a)
+		}
+	}
+	if len(c.algos) == 0 {
+		return nil, nil
+	}
+	return c, nil
+}
+
+// negotiate picks the first server-preferred algorithm the client accepts
+// with a non-zero q, or "" for identity.
+func (c *compression) negotiate(acceptEncoding string) string {
+	offered := make(map[string]bool)
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				q = f
+			}
+		}
+		offered[strings.ToLower(strings.TrimSpace(name))] = q > 0
+	}
+	for _, a := range c.algos {
+		if ok, listed := offered[a]; ok || (!listed && offered["*"]) {
+			return a
+		}
+	}
+	return ""
+}
+
+// wrap returns a writer that compresses with algo, plus a finish func the
+// caller must run once the handler returns. Every response gets
+// Vary: Accept-Encoding since its encoding depends on that header.
+func (c *compression) wrap(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, func()) {
+	w.Header().Add("Vary", "Accept-Encoding")
+	algo := c.negotiate(r.Header.Get("Accept-Encoding"))
+	if algo == "" || r.Method == http.MethodHead {
+		return w, func() {}
+	}
+	cw := &compressWriter{ResponseWriter: w, min: c.min, algo: algo}
+	return cw, cw.finish
+}
+
+// compressWriter decides on the first body write: handlers here write their
+// JSON in one call, so that write's size is the body size. Status is held back
+// until then because Content-Encoding must precede it.
+type compressWriter struct {
+	http.ResponseWriter
+	min     int
+	algo    string
+	status  int
+	decided bool
+	gz      *gzip.Writer
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.status == 0 {
+		cw.status = status
+	}
+}
+
+func (cw *compressWriter) decide(size int) {
+	if cw.decided {
+		return
+	}
+	cw.decided = true
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+	h := cw.Header()
+	if size >= cw.min && h.Get("Content-Encoding") == "" &&
+		cw.status != http.StatusNoContent && cw.status != http.StatusNotModified {
+		h.Set("Content-Encoding", cw.algo)
+		h.Del("Content-Length")
+		cw.gz = gzip.NewWriter(cw.ResponseWriter)
+	}
+	cw.ResponseWriter.WriteHeader(cw.status)
+}
+
+func (cw *compressWriter) Write(p []byte) (int, error) {
+	cw.decide(len(p))
+	if cw.gz != nil {
+		return cw.gz.Write(p)
+	}
+	return cw.ResponseWriter.Write(p)
+}
+
+func (cw *compressWriter) Flush() {
+	if cw.gz != nil {
+		_ = cw.gz.Flush()
+	}
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (cw *compressWriter) finish() {
+	if !cw.decided && cw.status != 0 {
+		cw.decide(0)
+	}
+	if cw.gz != nil {
+		_ = cw.gz.Close()
+	}
+}
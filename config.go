@@ -0,0 +1,739 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ------- config -------
+
+// Config is everything read from the environment at startup.
+type Config struct {
+	SAJSON              []byte
+	ImpersonateSA       string
+	ImpersonateLifetime time.Duration
+	Providers           []providerConfig
+	RouteAudiences      routeAudiences
+	Scope               string
+	Port                string
+	ListenNetwork       string      // tcp or unix
+	ListenAddr          string      // host:port, or the socket path
+	ListenSocketMode    os.FileMode // unix socket permissions
+
+	ShutdownTimeout time.Duration
+	LogLevel        string
+
+	// http.Server timeouts; 0 disables one
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	MaxInFlight       int // concurrent requests before 503; 0 disables
+	MaxBodyBytes      int // request body limit before 413
+
+	TLSCertFile   string
+	TLSKeyFile    string
+	TLSMinVersion uint16
+
+	CORSOrigin            string
+	CORSRouteOrigins      map[string]string // by corsRouteNames, resolved against CORSOrigin
+	CORSCredentials       bool
+	AllowedHD             string
+	DiscloseAllowedDomain bool
+	AdminToken            string
+	RootResponse          string
+	ResponseMin           time.Duration
+	ResponseCase          responseCase
+	ErrorCompat           bool
+	CompressAlgos         []string
+	CompressMinBytes      int
+
+	AllowedHosts              map[string]bool
+	AllowedHostsExemptHealthz bool
+
+	RequireUserAgent      bool
+	AllowDuplicateAuthz   bool
+	TokenCookieName       string
+	EmailMatch            emailMatch
+	RequireEmail          bool
+	RequireEmailVerified  bool
+	MinIDTokenRemaining   time.Duration
+	OIDCSkew              time.Duration
+	ReplayProtection      bool
+	ReplayMaxUses         int
+	PrefetchJWKS          bool
+	PrefetchJWKSAttempts  int
+	KeysetRefreshInterval time.Duration
+	VerifyCacheSize       int
+
+	TrustedProxies cidrList
+	XFFTrustedHops int
+	InternalNets   cidrList
+	DenyIPs        cidrList
+	DenySubjects   map[string]bool
+
+	AllowedSubjects map[string]bool
+	AllowedEmails   map[string]bool
+	// re-read the lists' files when they change (0: only on SIGHUP)
+	AccessListsReloadInterval time.Duration
+	ShadowGates               map[string]bool // gates that log instead of rejecting
+
+	MintRetries         int
+	MintBackoff         time.Duration
+	TokenCache          bool
+	ReadyAfterFirstMint bool
+	ReadyMintFailures   int
+	StartupSelftest     bool
+	RefreshSkew         time.Duration
+
+	MetricsEnabled bool
+	MetricsAddr    string
+	OTelEndpoint   string // OTLP/HTTP collector; empty disables tracing
+	MetricsDomains []string
+
+	UserPerMin, UserBurst           int
+	IPPerMin, IPBurst               int
+	TokenPerMin, TokenBurst         int // per-route limits default to the global ones
+	TokenIPPerMin, TokenIPBurst     int
+	WhoamiPerMin, WhoamiBurst       int
+	WhoamiIPPerMin, WhoamiIPBurst   int
+	CleanupMins                     int
+	LimiterColdTokens               int
+	EnforcementWarmup               time.Duration
+	EnforcementWarmupFactor         float64
+	RetryAfterFactor                float64
+	RetryAfterMax                   time.Duration
+	LimiterOverridesFile            string
+	UseTrailers                     bool
+	RatelimitHeaders                bool
+	RatelimitPerMin, RatelimitBurst int
+
+	RedisURL       string
+	RedisFallback  string
+	RedisTimeout   time.Duration
+	RedisKeyPrefix string
+	RedisReadyz    bool
+
+	AllowedCountries []string
+	BlockedCountries []string
+	GeoIPDB          string
+
+	AuditLogFile  string
+	AuditBuffer   int
+	AuditOverflow string
+
+	WebhookURL     string
+	WebhookSecret  string
+	WebhookBuffer  int
+	WebhookRetries int
+	WebhookTimeout time.Duration
+
+	OutboundProxyURL      string
+	OutboundProxyUser     string
+	OutboundProxyPassword string
+
+	AllowedScopes   map[string]bool
+	ScopePolicyFile string
+
+	DownscopePolicyFile string
+	ServiceAccountsFile string
+
+	MaxTokenLifetime  time.Duration
+	DeprecateGetToken bool
+	GetTokenSunset    time.Time
+
+	Introspect            bool
+	IntrospectAnyAudience bool
+
+	ClientCredentialsFile         string
+	ClientPerMin, ClientBurst     int
+	TokenStream                   bool
+	StreamMaxPerUser              int
+	StreamRefreshBefore           time.Duration
+	Userinfo                      bool
+	UserinfoTTL                   time.Duration
+	UserinfoPerMin, UserinfoBurst int
+	IDTokenAudiences              map[string]bool // /idtoken; empty disables it
+	TicketSigningKey              []byte          // /ticket; empty disables it
+	TicketIssuer                  string
+	TicketTTL                     time.Duration
+}
+
+// loadConfig reads and validates the whole environment, reporting every
+// missing or invalid variable at once rather than stopping at the first.
+func loadConfig() (Config, error) {
+	var e envReader
+	c := Config{
+		Scope: e.str("TOKEN_SCOPE", "https://www.googleapis.com/auth/cloud-platform"),
+		Port:  e.str("PORT", "10000"),
+
+		ShutdownTimeout: e.duration("SHUTDOWN_TIMEOUT", 15*time.Second),
+		LogLevel:        e.oneOf("LOG_LEVEL", "info", "debug", "info", "warn", "error"),
+
+		ReadHeaderTimeout: e.duration("READ_HEADER_TIMEOUT", 10*time.Second),
+		ReadTimeout:       e.duration("READ_TIMEOUT", 30*time.Second),
+		WriteTimeout:      e.duration("WRITE_TIMEOUT", time.Minute),
+		IdleTimeout:       e.duration("IDLE_TIMEOUT", 2*time.Minute),
+		MaxInFlight:       e.integer("MAX_INFLIGHT", 1000),
+		MaxBodyBytes:      e.integer("MAX_BODY_BYTES", 16<<10),
+
+		CORSOrigin:            e.str("CORS_ORIGIN", "*"),
+		CORSCredentials:       e.boolean("CORS_ALLOW_CREDENTIALS", false),
+		DiscloseAllowedDomain: e.boolean("DISCLOSE_ALLOWED_DOMAIN", false),
+		AdminToken:            e.str("ADMIN_TOKEN", ""),
+		RootResponse:          e.oneOf("ROOT_RESPONSE", "json", "json", "empty"),
+		ResponseMin:           time.Duration(e.integer("RESPONSE_MIN_MS", 0)) * time.Millisecond,
+		ResponseCase:          responseCase(e.oneOf("RESPONSE_CASE", "snake", "snake", "camel")),
+		ErrorCompat:           e.boolean("ERROR_COMPAT", false),
+		CompressAlgos:         e.list("COMPRESS_ALGOS"),
+		CompressMinBytes:      e.integer("COMPRESS_MIN_BYTES", 1024),
+
+		AllowedHostsExemptHealthz: e.boolean("ALLOWED_HOSTS_EXEMPT_HEALTHZ", false),
+
+		RequireUserAgent:      e.boolean("REQUIRE_USER_AGENT", false),
+		AllowDuplicateAuthz:   e.boolean("ALLOW_DUPLICATE_AUTHORIZATION", false),
+		TokenCookieName:       e.str("TOKEN_COOKIE_NAME", ""),
+		RequireEmail:          e.boolean("REQUIRE_EMAIL", false),
+		RequireEmailVerified:  e.boolean("REQUIRE_EMAIL_VERIFIED", false),
+		MinIDTokenRemaining:   e.duration("MIN_ID_TOKEN_REMAINING", 0),
+		OIDCSkew:              e.duration("OIDC_SKEW_SECONDS", 30*time.Second),
+		ReplayProtection:      e.boolean("REPLAY_PROTECTION", false),
+		ReplayMaxUses:         e.integer("REPLAY_MAX_USES", 1),
+		PrefetchJWKS:          e.boolean("PREFETCH_JWKS", false),
+		PrefetchJWKSAttempts:  e.integer("PREFETCH_JWKS_ATTEMPTS", 5),
+		KeysetRefreshInterval: e.duration("KEYSET_REFRESH_INTERVAL", 0),
+		VerifyCacheSize:       e.integer("VERIFY_CACHE_SIZE", 0),
+
+		TrustedProxies: e.cidrs("TRUSTED_PROXIES"),
+		XFFTrustedHops: e.integer("XFF_TRUSTED_HOPS", 0),
+		InternalNets:   e.cidrs("INTERNAL_CIDRS"),
+		DenyIPs:        e.cidrs("DENY_IPS"),
+
+		MintRetries:         e.integer("MINT_RETRIES", 2),
+		MintBackoff:         e.duration("MINT_BACKOFF", 200*time.Millisecond),
+		TokenCache:          e.boolean("TOKEN_CACHE", true),
+		ReadyAfterFirstMint: e.boolean("READY_AFTER_FIRST_MINT", false),
+		ReadyMintFailures:   e.integer("READY_MINT_FAILURES", 5),
+		StartupSelftest:     e.boolean("STARTUP_SELFTEST", false),
+		RefreshSkew:         e.duration("REFRESH_SKEW_SECONDS", 120*time.Second),
+
+		MetricsEnabled: e.boolean("METRICS_ENABLED", false),
+		MetricsAddr:    e.str("METRICS_ADDR", ""),
+		OTelEndpoint:   e.str("OTEL_EXPORTER_OTLP_ENDPOINT", ""),
+		MetricsDomains: e.list("METRICS_DOMAINS"),
+
+		UserPerMin:              e.integer("RATE_PER_MIN", 60),
+		UserBurst:               e.integer("RATE_BURST", 30),
+		IPPerMin:                e.integer("IP_RATE_PER_MIN", 120),
+		IPBurst:                 e.integer("IP_BURST", 60),
+		CleanupMins:             e.integer("RATE_CLEANUP_MINS", 30),
+		LimiterColdTokens:       e.integer("LIMITER_COLD_TOKENS", -1),
+		EnforcementWarmup:       e.duration("ENFORCEMENT_WARMUP", 0),
+		EnforcementWarmupFactor: e.float("ENFORCEMENT_WARMUP_FACTOR", 3),
+		RetryAfterFactor:        e.float("RETRY_AFTER_ESCALATION", 1),
+		RetryAfterMax:           e.duration("RETRY_AFTER_MAX", 5*time.Minute),
+		LimiterOverridesFile:    e.str("LIMITER_OVERRIDES_FILE", ""),
+		UseTrailers:             e.boolean("USE_TRAILERS", false),
+		RatelimitHeaders:        e.boolean("RATELIMIT_HEADERS", false),
+		RatelimitPerMin:         e.integer("RATELIMIT_RATE_PER_MIN", 30),
+		RatelimitBurst:          e.integer("RATELIMIT_BURST", 10),
+
+		RedisURL:       e.str("REDIS_URL", ""),
+		RedisFallback:  e.oneOf("REDIS_FALLBACK", fallbackLocal, fallbackLocal, fallbackFailOpen, fallbackFailClosed),
+		RedisTimeout:   e.duration("REDIS_TIMEOUT", 200*time.Millisecond),
+		RedisKeyPrefix: e.str("REDIS_KEY_PREFIX", "tokenbroker:"),
+
+		AllowedCountries: e.list("ALLOWED_COUNTRIES"),
+		BlockedCountries: e.list("BLOCKED_COUNTRIES"),
+
+		AuditLogFile:  e.str("AUDIT_LOG_FILE", ""),
+		AuditBuffer:   e.integer("AUDIT_BUFFER", 1024),
+		AuditOverflow: e.oneOf("AUDIT_OVERFLOW", "drop", "drop", "block"),
+
+		WebhookURL:     e.str("ISSUANCE_WEBHOOK_URL", ""),
+		WebhookBuffer:  e.integer("ISSUANCE_WEBHOOK_BUFFER", 1024),
+		WebhookRetries: e.integer("ISSUANCE_WEBHOOK_RETRIES", 3),
+		WebhookTimeout: e.duration("ISSUANCE_WEBHOOK_TIMEOUT", 5*time.Second),
+
+		OutboundProxyURL:      e.str("OUTBOUND_PROXY_URL", ""),
+		OutboundProxyUser:     e.str("OUTBOUND_PROXY_USER", ""),
+		OutboundProxyPassword: e.str("OUTBOUND_PROXY_PASSWORD", ""),
+
+		ScopePolicyFile: e.str("SCOPE_POLICY_FILE", ""),
+
+		DownscopePolicyFile: e.str("DOWNSCOPE_POLICY_FILE", ""),
+		ServiceAccountsFile: e.str("SERVICE_ACCOUNTS_FILE", ""),
+
+		DeprecateGetToken: e.boolean("DEPRECATE_GET_TOKEN", false),
+		GetTokenSunset:    e.date("GET_TOKEN_SUNSET"),
+
+		Introspect:            e.boolean("ENABLE_INTROSPECT", false),
+		IntrospectAnyAudience: e.boolean("INTROSPECT_ANY_AUDIENCE", false),
+
+		ClientCredentialsFile: e.str("CLIENT_CREDENTIALS_FILE", ""),
+		ClientPerMin:          e.integer("CLIENT_RATE_PER_MIN", 60),
+		ClientBurst:           e.integer("CLIENT_BURST", 30),
+		TokenStream:           e.boolean("ENABLE_TOKEN_STREAM", false),
+		StreamMaxPerUser:      e.integer("TOKEN_STREAM_MAX_PER_USER", 2),
+		StreamRefreshBefore:   e.duration("TOKEN_STREAM_REFRESH_BEFORE", 5*time.Minute),
+		Userinfo:              e.boolean("ENABLE_USERINFO", false),
+		UserinfoTTL:           e.duration("USERINFO_CACHE_TTL", 5*time.Minute),
+		UserinfoPerMin:        e.integer("USERINFO_RATE_PER_MIN", 10),
+		UserinfoBurst:         e.integer("USERINFO_BURST", 5),
+		IDTokenAudiences:      e.set("ID_TOKEN_AUDIENCES"),
+		TicketSigningKey:      []byte(e.str("TICKET_SIGNING_KEY", "")),
+		TicketIssuer:          e.str("TICKET_ISSUER", "token-broker"),
+		TicketTTL:             e.duration("TICKET_TTL", 5*time.Minute),
+	}
+
+	// Minting credentials: impersonate IMPERSONATE_SA_EMAIL with ADC, or
+	// fall back to the GOOGLE_SA_JSON key
+	if c.ImpersonateSA = e.str("IMPERSONATE_SA_EMAIL", ""); c.ImpersonateSA != "" {
+		c.ImpersonateLifetime = e.duration("IMPERSONATE_LIFETIME", time.Hour)
+		if c.ImpersonateLifetime < time.Second || c.ImpersonateLifetime > 12*time.Hour {
+			e.fail("IMPERSONATE_LIFETIME must be between 1s and 12h")
+		}
+		if c.Userinfo {
+			e.fail("ENABLE_USERINFO needs domain-wide delegation, which requires GOOGLE_SA_JSON rather than IMPERSONATE_SA_EMAIL")
+		}
+	} else {
+		if c.SAJSON = []byte(e.required("GOOGLE_SA_JSON")); len(c.SAJSON) > 0 {
+			if err := checkCredentials(c.SAJSON); err != nil {
+				e.fail("GOOGLE_SA_JSON: %v", err)
+			} else if t, _ := credentialsType(c.SAJSON); t != credServiceAccount {
+				if c.Userinfo {
+					e.fail("ENABLE_USERINFO needs domain-wide delegation, which requires a service_account key in GOOGLE_SA_JSON, not %s", t)
+				}
+				if len(c.IDTokenAudiences) > 0 {
+					e.fail("ID_TOKEN_AUDIENCES needs a service_account key in GOOGLE_SA_JSON or IMPERSONATE_SA_EMAIL, not %s", t)
+				}
+			}
+		}
+	}
+
+	if c.WebhookURL != "" {
+		c.WebhookSecret = e.required("ISSUANCE_WEBHOOK_SECRET")
+	}
+
+	if c.MaxTokenLifetime = time.Duration(e.integer("MAX_TOKEN_LIFETIME", 3600)) * time.Second; c.MaxTokenLifetime <= 0 {
+		e.fail("MAX_TOKEN_LIFETIME must be positive")
+	}
+
+	c.ListenNetwork = e.oneOf("LISTEN_NETWORK", "tcp", "tcp", "unix")
+	c.ListenAddr = e.str("LISTEN_ADDR", "")
+	if c.ListenAddr == "" {
+		if c.ListenNetwork == "unix" {
+			e.fail("LISTEN_ADDR: a socket path is required with LISTEN_NETWORK=unix")
+		}
+		c.ListenAddr = ":" + c.Port
+	}
+	if mode, err := strconv.ParseUint(e.str("LISTEN_SOCKET_MODE", "0600"), 8, 32); err != nil || mode > 0o777 {
+		e.fail("LISTEN_SOCKET_MODE: want octal permissions like 0660")
+	} else {
+		c.ListenSocketMode = os.FileMode(mode)
+	}
+
+	c.TLSCertFile, c.TLSKeyFile = e.str("TLS_CERT_FILE", ""), e.str("TLS_KEY_FILE", "")
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		e.fail("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	if v, err := parseTLSVersion(e.str("TLS_MIN_VERSION", "1.2")); err != nil {
+		e.fail("TLS_MIN_VERSION: %v", err)
+	} else {
+		c.TLSMinVersion = v
+	}
+
+	// OIDC providers: OIDC_PROVIDERS (JSON list), or OIDC_CLIENT_ID accepted
+	// from each of OIDC_ISSUERS (default Google)
+	if v := e.str("OIDC_PROVIDERS", ""); v != "" {
+		if err := json.Unmarshal([]byte(v), &c.Providers); err != nil {
+			e.fail("OIDC_PROVIDERS: %v", err)
+		}
+	} else if ids := e.required("OIDC_CLIENT_ID"); ids != "" {
+		issuers := e.list("OIDC_ISSUERS")
+		if len(issuers) == 0 {
+			issuers = []string{googleIssuer}
+		}
+		for _, iss := range issuers {
+			c.Providers = append(c.Providers, providerConfig{Issuer: iss, ClientIDs: strings.Split(ids, ",")})
+		}
+	}
+	maxAudiences := e.integer("MAX_AUDIENCES", 10)
+	for i := range c.Providers {
+		ids, err := normalizeAudiences(c.Providers[i].ClientIDs, maxAudiences)
+		if err != nil {
+			e.fail("audiences for %s: %v", c.Providers[i].Issuer, err)
+		}
+		c.Providers[i].ClientIDs = ids
+	}
+
+	// ROUTE_AUDIENCES: {"/token": ["<client id>"], ...}, plus the
+	// TOKEN_AUDIENCE (every minting route) and WHOAMI_AUDIENCE shorthands.
+	// Each audience must also be a configured client id, or no token could
+	// ever pass.
+	raw := make(map[string][]string)
+	if v := e.str("ROUTE_AUDIENCES", ""); v != "" {
+		if err := json.Unmarshal([]byte(v), &raw); err != nil {
+			e.fail("ROUTE_AUDIENCES: %v", err)
+		}
+	}
+	from := make(map[string]string, len(raw))
+	for route := range raw {
+		if !audienceRoutes[route] {
+			e.fail("ROUTE_AUDIENCES: unknown route %q", route)
+		}
+		from[route] = "ROUTE_AUDIENCES"
+	}
+	shorthand := func(key string, routes ...string) {
+		auds := e.list(key)
+		if len(auds) == 0 {
+			return
+		}
+		for _, route := range routes {
+			if _, dup := raw[route]; dup {
+				e.fail("%s: %s is already restricted by %s", key, route, from[route])
+				continue
+			}
+			raw[route], from[route] = auds, key
+		}
+	}
+	shorthand("TOKEN_AUDIENCE", "/token", "/token/batch", "/token/stream", "/token/introspect", "/idtoken", "/ticket")
+	shorthand("WHOAMI_AUDIENCE", "/whoami")
+	if len(raw) > 0 {
+		known := make(map[string]bool)
+		for _, pc := range c.Providers {
+			for _, id := range pc.ClientIDs {
+				known[id] = true
+			}
+		}
+		c.RouteAudiences = make(routeAudiences, len(raw))
+		for route, auds := range raw {
+			if len(auds) == 0 {
+				e.fail("%s: %s lists no audiences", from[route], route)
+			}
+			c.RouteAudiences[route] = make(map[string]bool, len(auds))
+			for _, aud := range auds {
+				aud = strings.TrimSpace(aud)
+				if !known[aud] {
+					e.fail("%s: %s: %.8q… is not a configured client id", from[route], route, aud)
+				}
+				c.RouteAudiences[route][aud] = true
+			}
+		}
+	}
+
+	if m, err := parseEmailMatch(e.str("EMAIL_MATCH", "ci")); err != nil {
+		e.fail("EMAIL_MATCH: %v", err)
+	} else {
+		c.EmailMatch = m
+	}
+	lists := readAccessLists(&e, c.EmailMatch)
+	c.AllowedHD, c.DenySubjects = lists.allowedHD, lists.denySubjects
+	c.AllowedSubjects, c.AllowedEmails = lists.allowedSubjects, lists.allowedEmails
+	c.AccessListsReloadInterval = e.duration("ACCESS_LISTS_RELOAD_INTERVAL", 0)
+	c.ShadowGates = readShadowGates(&e)
+
+	c.TokenPerMin = e.integer("TOKEN_RATE_PER_MIN", c.UserPerMin)
+	c.TokenBurst = e.integer("TOKEN_BURST", c.UserBurst)
+	c.TokenIPPerMin = e.integer("TOKEN_IP_RATE_PER_MIN", c.IPPerMin)
+	c.TokenIPBurst = e.integer("TOKEN_IP_BURST", c.IPBurst)
+	c.WhoamiPerMin = e.integer("WHOAMI_RATE_PER_MIN", c.UserPerMin)
+	c.WhoamiBurst = e.integer("WHOAMI_BURST", c.UserBurst)
+	c.WhoamiIPPerMin = e.integer("WHOAMI_IP_RATE_PER_MIN", c.IPPerMin)
+	c.WhoamiIPBurst = e.integer("WHOAMI_IP_BURST", c.IPBurst)
+
+	for _, l := range []struct {
+		name  string
+		value int
+	}{
+		{"RATE_PER_MIN", c.UserPerMin}, {"RATE_BURST", c.UserBurst},
+		{"IP_RATE_PER_MIN", c.IPPerMin}, {"IP_BURST", c.IPBurst},
+		{"TOKEN_RATE_PER_MIN", c.TokenPerMin}, {"TOKEN_BURST", c.TokenBurst},
+		{"TOKEN_IP_RATE_PER_MIN", c.TokenIPPerMin}, {"TOKEN_IP_BURST", c.TokenIPBurst},
+		{"WHOAMI_RATE_PER_MIN", c.WhoamiPerMin}, {"WHOAMI_BURST", c.WhoamiBurst},
+		{"WHOAMI_IP_RATE_PER_MIN", c.WhoamiIPPerMin}, {"WHOAMI_IP_BURST", c.WhoamiIPBurst},
+		{"RATELIMIT_RATE_PER_MIN", c.RatelimitPerMin}, {"RATELIMIT_BURST", c.RatelimitBurst},
+		{"CLIENT_RATE_PER_MIN", c.ClientPerMin}, {"CLIENT_BURST", c.ClientBurst},
+		{"USERINFO_RATE_PER_MIN", c.UserinfoPerMin}, {"USERINFO_BURST", c.UserinfoBurst},
+	} {
+		if l.value <= 0 {
+			e.fail("%s must be positive, got %d", l.name, l.value)
+		}
+	}
+
+	if err := checkCORSOrigins(c.CORSOrigin); err != nil && !strings.EqualFold(c.CORSOrigin, "none") {
+		e.fail("CORS_ORIGIN: %v", err)
+	}
+	if c.CORSCredentials {
+		if p := newCORSPolicy(c.CORSOrigin, true); p != nil && p.any {
+			e.fail("CORS_ALLOW_CREDENTIALS needs an explicit CORS_ORIGIN list, not *")
+		}
+	}
+	c.CORSRouteOrigins = make(map[string]string, len(corsRouteNames))
+	for _, name := range corsRouteNames {
+		key := "CORS_ORIGIN_" + name
+		origin := e.str(key, "")
+		if origin == "" {
+			c.CORSRouteOrigins[name] = c.CORSOrigin
+			continue
+		}
+		if err := checkCORSOrigins(origin); err != nil && !strings.EqualFold(origin, "none") {
+			e.fail("%s: %v", key, err)
+		}
+		if p := newCORSPolicy(origin, true); c.CORSCredentials && p != nil && p.any {
+			e.fail("CORS_ALLOW_CREDENTIALS needs an explicit %s list, not *", key)
+		}
+		c.CORSRouteOrigins[name] = origin
+	}
+
+	if c.TokenCookieName != "" {
+		if err := (&http.Cookie{Name: c.TokenCookieName}).Valid(); err != nil {
+			e.fail("TOKEN_COOKIE_NAME: %v", err)
+		}
+		// the cookie only reaches cross-origin requests made with credentials
+		if !c.CORSCredentials {
+			e.fail("TOKEN_COOKIE_NAME needs CORS_ALLOW_CREDENTIALS=true and an explicit CORS_ORIGIN list")
+		}
+	}
+
+	if c.RedisURL != "" {
+		if _, err := parseRedisURL(c.RedisURL, c.RedisTimeout); err != nil {
+			e.fail("REDIS_URL: %v", err)
+		}
+		if c.RedisTimeout <= 0 {
+			e.fail("REDIS_TIMEOUT must be positive")
+		}
+	}
+	c.RedisReadyz = e.boolean("REDIS_READYZ", c.RedisFallback == fallbackFailClosed)
+
+	for _, t := range []struct {
+		name  string
+		value time.Duration
+	}{
+		{"READ_HEADER_TIMEOUT", c.ReadHeaderTimeout}, {"READ_TIMEOUT", c.ReadTimeout},
+		{"WRITE_TIMEOUT", c.WriteTimeout}, {"IDLE_TIMEOUT", c.IdleTimeout},
+	} {
+		if t.value < 0 {
+			e.fail("%s must not be negative", t.name)
+		}
+	}
+
+	if c.ReplayMaxUses <= 0 {
+		e.fail("REPLAY_MAX_USES must be positive")
+	}
+
+	if c.MaxInFlight < 0 {
+		e.fail("MAX_INFLIGHT must not be negative")
+	}
+	if c.MaxBodyBytes <= 0 {
+		e.fail("MAX_BODY_BYTES must be positive")
+	}
+
+	if len(c.TicketSigningKey) > 0 && len(c.TicketSigningKey) < minTicketKeyLen {
+		e.fail("TICKET_SIGNING_KEY must be at least %d bytes", minTicketKeyLen)
+	}
+	if c.TicketTTL < time.Second || c.TicketTTL > time.Hour {
+		e.fail("TICKET_TTL must be between 1s and 1h")
+	}
+
+	if c.ReadyMintFailures < 0 {
+		e.fail("READY_MINT_FAILURES must not be negative")
+	}
+
+	if c.XFFTrustedHops < 0 {
+		e.fail("XFF_TRUSTED_HOPS must not be negative")
+	}
+	if c.XFFTrustedHops > 0 && len(c.TrustedProxies) > 0 {
+		e.fail("set only one of TRUSTED_PROXIES and XFF_TRUSTED_HOPS")
+	}
+
+	if len(c.AllowedCountries) > 0 || len(c.BlockedCountries) > 0 {
+		c.GeoIPDB = e.required("GEOIP_DB")
+	}
+
+	c.AllowedHosts = make(map[string]bool)
+	for _, h := range e.list("ALLOWED_HOSTS") {
+		c.AllowedHosts[strings.ToLower(h)] = true
+	}
+
+	c.AllowedScopes = e.set("ALLOWED_SCOPES")
+	if len(c.AllowedScopes) == 0 {
+		c.AllowedScopes[c.Scope] = true
+	}
+
+	return c, errors.Join(e.errs...)
+}
+
+// envReader reads env vars, recording a problem for each missing required or
+// unparsable value and returning the default in its place.
+type envReader struct {
+	errs []error
+}
+
+func (e *envReader) fail(format string, args ...any) {
+	e.errs = append(e.errs, fmt.Errorf(format, args...))
+}
+
+func (e *envReader) str(key, def string) string {
+	if v := strings.TrimSpace(os.Getenv(key)); v != "" {
+		return v
+	}
+	return def
+}
+
+func (e *envReader) required(key string) string {
+	v := strings.TrimSpace(os.Getenv(key))
+	if v == "" {
+		e.fail("%s is required", key)
+	}
+	return v
+}
+
+func (e *envReader) oneOf(key, def string, allowed ...string) string {
+	v := e.str(key, def)
+	for _, a := range allowed {
+		if v == a {
+			return v
+		}
+	}
+	e.fail("%s must be one of %s, got %q", key, strings.Join(allowed, "|"), v)
+	return def
+}
+
+func (e *envReader) integer(key string, def int) int {
+	v := e.str(key, "")
+	if v == "" {
+		return def
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		e.fail("%s: invalid integer %q", key, v)
+		return def
+	}
+	return i
+}
+
+func (e *envReader) boolean(key string, def bool) bool {
+	v := e.str(key, "")
+	if v == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		e.fail("%s: invalid boolean %q", key, v)
+		return def
+	}
+	return b
+}
+
+func (e *envReader) float(key string, def float64) float64 {
+	v := e.str(key, "")
+	if v == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		e.fail("%s: invalid number %q", key, v)
+		return def
+	}
+	return f
+}
+
+// duration accepts plain seconds or a Go duration ("30", "5m").
+func (e *envReader) duration(key string, def time.Duration) time.Duration {
+	v := e.str(key, "")
+	if v == "" {
+		return def
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		return time.Duration(secs) * time.Second
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		e.fail("%s: invalid duration %q", key, v)
+		return def
+	}
+	return d
+}
+
+// date accepts a calendar date ("2027-01-31", midnight UTC) or RFC 3339.
+func (e *envReader) date(key string) time.Time {
+	v := e.str(key, "")
+	if v == "" {
+		return time.Time{}
+	}
+	for _, layout := range []string{time.DateOnly, time.RFC3339} {
+		if t, err := time.Parse(layout, v); err == nil {
+			return t.UTC()
+		}
+	}
+	e.fail("%s: invalid date %q", key, v)
+	return time.Time{}
+}
+
+// list splits a comma-separated value, trimming entries and dropping empties.
+func (e *envReader) list(key string) []string {
+	var out []string
+	for _, v := range strings.Split(os.Getenv(key), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+func (e *envReader) set(key string) map[string]bool {
+	out := make(map[string]bool)
+	for _, v := range e.list(key) {
+		out[v] = true
+	}
+	return out
+}
+
+// fileSet is set(key) plus the entries of the file named by key_FILE, for
+// lists too long to inline.
+func (e *envReader) fileSet(key string) map[string]bool {
+	out := e.set(key)
+	if path := e.str(key+"_FILE", ""); path != "" {
+		vals, err := readListFile(path)
+		if err != nil {
+			e.fail("%s_FILE: %v", key, err)
+		}
+		for _, v := range vals {
+			out[v] = true
+		}
+	}
+	return out
+}
+
+// readListFile reads one entry per line, skipping blank lines and # comments.
+func readListFile(path string) ([]string, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var out []string
+	for _, line := range strings.Split(string(buf), "\n") {
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		if line = strings.TrimSpace(line); line != "" {
+			out = append(out, line)
+		}
+	}
+	return out, nil
+}
+
+func (e *envReader) cidrs(key string) cidrList {
+	l, err := parseCIDRList(e.list(key))
+	if err != nil {
+		e.fail("%s: %v", key, err)
+	}
+	return l
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// ------- per-route CORS -------
+
+// corsPolicy is the CORS configuration for a single route. A nil policy
+// means the route is not CORS-enabled.
+type corsPolicy struct {
+	any         bool     // "*": every origin
+	origins     []string // otherwise only these, echoed back
+	credentials bool
+	methods     string
+}
+
+// newCORSPolicy parses a comma-separated origin list; "none" (or an empty
+// list) returns nil. A "*" entry allows every origin.
+func newCORSPolicy(origins string, credentials bool) *corsPolicy {
+	if strings.EqualFold(strings.TrimSpace(origins), "none") {
+		return nil
+	}
+	p := &corsPolicy{credentials: credentials, methods: "GET, OPTIONS"}
+	for _, o := range strings.Split(origins, ",") {
+		switch o = strings.TrimSuffix(strings.TrimSpace(o), "/"); o {
+		case "":
+		case "*":
+			p.any = true
+		default:
+			p.origins = append(p.origins, o)
+		}
+	}
+	if !p.any && len(p.origins) == 0 {
+		return nil
+	}
+	return p
+}
+
+// allowOrigin returns the Access-Control-Allow-Origin value for a request
+// from origin, or "" when it isn't allowed.
+func (p *corsPolicy) allowOrigin(origin string) string {
+	if p.any {
+		return "*"
+	}
+	for _, o := range p.origins {
+		if strings.EqualFold(o, origin) {
+			return origin
+		}
+	}
+	return ""
+}
+
+// apply sets the CORS headers for r's Origin. An origin not on the list
+// gets none at all, and credentials are only ever allowed for an echoed
+// origin, never with "*".
+func (p *corsPolicy) apply(w http.ResponseWriter, r *http.Request) {
+	if p == nil {
+		return
+	}
+	h := w.Header()
+	if !p.any && !hasVary(h, "Origin") {
+		h.Add("Vary", "Origin")
+	}
+	origin := p.allowOrigin(r.Header.Get("Origin"))
+	if origin == "" {
+		return
+	}
+	h.Set("Access-Control-Allow-Origin", origin)
+	h.Set("Access-Control-Allow-Headers", "authorization, content-type")
+	h.Set("Access-Control-Allow-Methods", p.methods)
+	if p.credentials && origin != "*" {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+func hasVary(h http.Header, name string) bool {
+	for _, v := range h.Values("Vary") {
+		for _, f := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(f), name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// corsRouteNames are the NAMEs with a CORS_ORIGIN_<NAME> override.
+var corsRouteNames = []string{"HEALTHZ", "WHOAMI", "TOKEN", "RATELIMIT", "IDTOKEN", "TICKET", "USERINFO"}
+
+// checkCORSOrigins rejects a CORS_ORIGIN list entry that is neither "*" nor
+// a scheme://host[:port] origin; "none" is checked by the caller.
+func checkCORSOrigins(origins string) error {
+	for _, o := range strings.Split(origins, ",") {
+		if o = strings.TrimSpace(o); o == "" || o == "*" {
+			continue
+		}
+		u, err := url.Parse(o)
+		if err != nil || u.Scheme == "" || u.Host == "" || u.User != nil || (u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.Fragment != "" {
+			return fmt.Errorf("%q is not an origin (want scheme://host[:port])", o)
+		}
+	}
+	return nil
+}
+
+// routeCORS builds the policy for a browser-facing route from its origins
+// in cfg: CORS_ORIGIN unless CORS_ORIGIN_<NAME> overrides it ("none"
+// disables CORS for the route).
+func routeCORS(cfg Config, name string) *corsPolicy {
+	return newCORSPolicy(cfg.CORSRouteOrigins[name], cfg.CORSCredentials)
+}
+
+// withMethods replaces a policy's allowed methods; nil stays nil.
+func (p *corsPolicy) withMethods(methods string) *corsPolicy {
+	if p != nil {
+		p.methods = methods
+	}
+	return p
+}
+
+// allows reports whether a preflight for method should succeed. An empty
+// method (no Access-Control-Request-Method) is treated as GET.
+func (p *corsPolicy) allows(method string) bool {
+	if method == "" {
+		method = http.MethodGet
+	}
+	for _, m := range strings.Split(p.methods, ",") {
+		if strings.EqualFold(strings.TrimSpace(m), method) {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultCORS is the global policy, used for preflight 404s on unknown paths
+// so browsers can read the rejection.
+func defaultCORS(globalOrigin string, credentials bool) *corsPolicy {
+	return newCORSPolicy(globalOrigin, credentials)
+}
+
+// corsRoutes maps exact paths to their policy; unlisted paths get no CORS.
+type corsRoutes map[string]*corsPolicy
+
+func (c corsRoutes) lookup(path string) *corsPolicy {
+	return c[path]
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+// ------- GOOGLE_SA_JSON credential types -------
+
+// The credential files GOOGLE_SA_JSON may hold, by their "type".
+const (
+	credServiceAccount  = "service_account"              // key file, signed JWT grant
+	credExternalAccount = "external_account"             // workload identity federation
+	credImpersonatedSA  = "impersonated_service_account" // source credentials + generateAccessToken
+)
+
+// credentialsType reads the "type" field of a credentials file, rejecting
+// the types the broker can't mint with.
+func credentialsType(buf []byte) (string, error) {
+	var f struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(buf, &f); err != nil {
+		return "", err
+	}
+	switch f.Type {
+	case credServiceAccount, credExternalAccount, credImpersonatedSA:
+		return f.Type, nil
+	case "":
+		return "", errors.New(`missing "type"`)
+	}
+	return "", fmt.Errorf("unsupported credential type %q (want %s, %s or %s)", f.Type, credServiceAccount, credExternalAccount, credImpersonatedSA)
+}
+
+// checkCredentials parses buf as far as minting will without calling
+// Google, so a truncated or mangled file fails at startup instead of on the
+// first mint. A service account key is checked down to the private key.
+func checkCredentials(buf []byte) error {
+	t, err := credentialsType(buf)
+	if err != nil {
+		return err
+	}
+	if t != credServiceAccount {
+		_, err := google.CredentialsFromJSON(context.Background(), buf, "https://www.googleapis.com/auth/cloud-platform")
+		return err
+	}
+	conf, err := google.JWTConfigFromJSON(buf)
+	if err != nil {
+		return err
+	}
+	if conf.Email == "" {
+		return errors.New("client_email is missing")
+	}
+	_, err = parseSAKey(conf.PrivateKey)
+	return err
+}
+
+// parseSAKey decodes a service account key's PEM private_key.
+func parseSAKey(pemBytes []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, errors.New("private_key is not PEM")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		if key, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+			return nil, errors.New("private_key: not a PKCS#8 or PKCS#1 key")
+		}
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("private_key is not an RSA key")
+	}
+	return rsaKey, nil
+}
+
+// newCredentialSources mints with an external_account or
+// impersonated_service_account file through google.CredentialsFromJSON.
+// Scopes are bound when the credentials are built, so each scope set (and
+// each fresh mint) builds its own.
+func newCredentialSources(ctx context.Context, buf []byte) *scopeSources {
+	return &scopeSources{ctx: ctx, src: make(map[string]*scopedSource),
+		build: func(scopes []string) (func(context.Context) oauth2.TokenSource, error) {
+			if _, err := google.CredentialsFromJSON(ctx, buf, scopes...); err != nil {
+				return nil, err
+			}
+			return func(ctx context.Context) oauth2.TokenSource {
+				creds, err := google.CredentialsFromJSON(ctx, buf, scopes...)
+				if err != nil {
+					return errorSource{err}
+				}
+				return creds.TokenSource
+			}, nil
+		},
+	}
+}
+
+// errorSource is a token source that always fails with err.
+type errorSource struct{ err error }
+
+func (s errorSource) Token() (*oauth2.Token, error) { return nil, s.err }
+
+// serviceAccountEmail is the account tokens are minted as: the key's
+// client_email, the account in the impersonation URL, or "" for a
+// federated identity used directly.
+func serviceAccountEmail(cfg Config) string {
+	if cfg.ImpersonateSA != "" {
+		return cfg.ImpersonateSA
+	}
+	return credentialsEmail(cfg.SAJSON)
+}
+
+func credentialsEmail(buf []byte) string {
+	var f struct {
+		ClientEmail      string `json:"client_email"`
+		ImpersonationURL string `json:"service_account_impersonation_url"`
+	}
+	if err := json.Unmarshal(buf, &f); err != nil {
+		return ""
+	}
+	if f.ClientEmail != "" {
+		return f.ClientEmail
+	}
+	// …/serviceAccounts/<email>:generateAccessToken
+	if _, rest, ok := strings.Cut(f.ImpersonationURL, "/serviceAccounts/"); ok {
+		email, _, _ := strings.Cut(rest, ":")
+		return email
+	}
+	return ""
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func readFixture(t *testing.T, name string) []byte {
+	t.Helper()
+	buf, err := os.ReadFile(filepath.Join("testdata", "credentials", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+func TestCredentialsType(t *testing.T) {
+	tests := []struct {
+		name    string
+		buf     []byte
+		want    string
+		wantErr string
+	}{
+		{"service account key", testSAJSON(t, newTestSigner(t, "sa").key, "https://oauth2.googleapis.com/token"), credServiceAccount, ""},
+		{"external account", readFixture(t, "external_account.json"), credExternalAccount, ""},
+		{"impersonated service account", readFixture(t, "impersonated_service_account.json"), credImpersonatedSA, ""},
+		{"authorized user", readFixture(t, "authorized_user.json"), "", "unsupported credential type"},
+		{"no type", []byte(`{"client_email":"a@b"}`), "", "missing"},
+		{"not JSON", []byte("not json"), "", "invalid character"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := credentialsType(tt.buf)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Fatalf("credentialsType = %q, %v; want %q", got, err, tt.want)
+			}
+			if err := checkCredentials(tt.buf); err != nil {
+				t.Errorf("checkCredentials: %v", err)
+			}
+			cfg := Config{SAJSON: tt.buf}
+			if got := serviceAccountEmail(cfg); got != "broker@project.iam.gserviceaccount.com" {
+				t.Errorf("serviceAccountEmail = %q", got)
+			}
+		})
+	}
+}
+
+func TestExternalAccountMints(t *testing.T) {
+	// STS exchanges the federated subject token for an access token.
+	var gotScope, gotSubject string
+	sts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		gotScope, gotSubject = r.PostForm.Get("scope"), r.PostForm.Get("subject_token")
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"access_token":"sts-token","issued_token_type":"urn:ietf:params:oauth:token-type:access_token","token_type":"Bearer","expires_in":3600}`))
+	}))
+	defer sts.Close()
+
+	subject := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(subject, []byte("federated-jwt"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	buf, err := json.Marshal(map[string]any{
+		"type":               credExternalAccount,
+		"audience":           "//iam.googleapis.com/projects/1/locations/global/workloadIdentityPools/p/providers/q",
+		"subject_token_type": "urn:ietf:params:oauth:token-type:jwt",
+		"token_url":          sts.URL,
+		"credential_source":  map[string]any{"file": subject},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := &googleMinter{sources: newScopeSources(context.Background(), buf)}
+	tok, err := m.Mint(context.Background(), whoamiResp{}, []string{cloudPlatformScope})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok.AccessToken != "sts-token" || gotSubject != "federated-jwt" || gotScope != cloudPlatformScope {
+		t.Errorf("minted %q with subject %q and scope %q", tok.AccessToken, gotSubject, gotScope)
+	}
+	if tok.Extra("scope") != cloudPlatformScope {
+		t.Errorf("scope extra = %v", tok.Extra("scope"))
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google/downscope"
+)
+
+// ------- resource downscoping -------
+
+// downscopeRule is the access boundary applied when a caller asks for a
+// token bound to one resource. Condition is an optional CEL expression.
+type downscopeRule struct {
+	Permissions []string `json:"permissions"`
+	Condition   *struct {
+		Expression  string `json:"expression"`
+		Title       string `json:"title,omitempty"`
+		Description string `json:"description,omitempty"`
+	} `json:"condition,omitempty"`
+}
+
+// downscopePolicy maps full resource names (e.g.
+// "//storage.googleapis.com/projects/_/buckets/reports") to their rule. The
+// keys are the allowlist: any other resource is refused. A nil policy
+// allows none.
+type downscopePolicy map[string]downscopeRule
+
+func loadDownscopePolicy(path string) (downscopePolicy, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var raw struct {
+		Resources downscopePolicy `json:"resources"`
+	}
+	if err := json.Unmarshal(buf, &raw); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	for res, rule := range raw.Resources {
+		if len(rule.Permissions) == 0 {
+			return nil, fmt.Errorf("resource %q: permissions are required", res)
+		}
+		if rule.Condition != nil && rule.Condition.Expression == "" {
+			return nil, fmt.Errorf("resource %q: condition needs an expression", res)
+		}
+	}
+	return raw.Resources, nil
+}
+
+func (p downscopePolicy) allows(resource string) bool {
+	_, ok := p[resource]
+	return ok
+}
+
+// downscope exchanges root at Google STS for a token limited by the
+// resource's access boundary. ctx carries the outbound client.
+func (p downscopePolicy) downscope(ctx context.Context, root *oauth2.Token, resource string) (*oauth2.Token, error) {
+	rule, ok := p[resource]
+	if !ok {
+		return nil, fmt.Errorf("resource %q not allowed", resource)
+	}
+	ab := downscope.AccessBoundaryRule{
+		AvailableResource:    resource,
+		AvailablePermissions: rule.Permissions,
+	}
+	if c := rule.Condition; c != nil {
+		ab.Condition = &downscope.AvailabilityCondition{
+			Expression:  c.Expression,
+			Title:       c.Title,
+			Description: c.Description,
+		}
+	}
+	ts, err := downscope.NewTokenSource(ctx, downscope.DownscopingConfig{
+		RootSource: oauth2.StaticTokenSource(root),
+		Rules:      []downscope.AccessBoundaryRule{ab},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ts.Token()
+}
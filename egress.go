@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+// ------- outbound proxy -------
+
+// egress carries the HTTP client used for calls to Google and the IdPs
+// (discovery, JWKS, token and userinfo endpoints). A nil egress leaves the
+// default client in place.
+type egress struct {
+	client *http.Client
+}
+
+// newEgress builds the outbound client. With proxyURL, all calls go through
+// that proxy (credentials from the URL or, when set, user/password, sent as
+// Proxy-Authorization); otherwise HTTP_PROXY and friends apply as usual.
+func newEgress(proxyURL, user, password string) (*egress, error) {
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	e := &egress{client: &http.Client{Transport: tr, Timeout: 30 * time.Second}}
+	if proxyURL == "" {
+		return e, nil
+	}
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("proxy scheme must be http or https, got %q", u.Scheme)
+	}
+	if user != "" {
+		u.User = url.UserPassword(user, password)
+	}
+	tr.Proxy = http.ProxyURL(u)
+	return e, nil
+}
+
+// clientFrom returns the client egress.ctx stored in ctx, or the default.
+func clientFrom(ctx context.Context) *http.Client {
+	if c, ok := ctx.Value(oauth2.HTTPClient).(*http.Client); ok {
+		return c
+	}
+	return http.DefaultClient
+}
+
+// ctx returns ctx carrying the egress client for both go-oidc and oauth2.
+// When ctx belongs to a request, the client stamps that request's id on
+// every outbound call.
+func (e *egress) ctx(ctx context.Context) context.Context {
+	if e == nil || e.client == nil {
+		return ctx
+	}
+	client := e.client
+	if id := requestIDOf(ctx); id != "" {
+		client = &http.Client{Transport: &requestIDTransport{base: client.Transport, id: id}, Timeout: client.Timeout}
+	}
+	ctx = oidc.ClientContext(ctx, client)
+	return context.WithValue(ctx, oauth2.HTTPClient, client)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// ------- error codes -------
+
+// errorCode is a stable, machine-readable failure code. Every code the
+// service emits is declared here and listed in errorCodes.
+type errorCode string
+
+const (
+	codeMissingUserAgent       errorCode = "missing_user_agent"
+	codeAmbiguousAuthorization errorCode = "ambiguous_authorization"
+	codeCookieOriginNotAllowed errorCode = "cookie_origin_not_allowed"
+	codeUnknownIssuer          errorCode = "unknown_issuer"
+	codeShuttingDown           errorCode = "shutting_down"
+	codeEmailRequired          errorCode = "email_required"
+	codeEmailUnverified        errorCode = "email_unverified"
+	codeIDTokenExpiring        errorCode = "id_token_expiring"
+	codeIDTokenExpired         errorCode = "id_token_expired"
+	codeIDTokenNotYetValid     errorCode = "id_token_not_yet_valid"
+	codeTokenReplayed          errorCode = "token_replayed"
+	codeGeoBlocked             errorCode = "geo_blocked"
+	codeDenied                 errorCode = "denied"
+	codeScopeRequired          errorCode = "scope_required"
+	codeScopeNotAllowed        errorCode = "scope_not_allowed"
+	codeScopeNotPermitted      errorCode = "scope_not_permitted"
+	codeTooManyStreams         errorCode = "too_many_streams"
+	codeUserinfoFailed         errorCode = "userinfo_failed"
+	codeUnsupportedGrantType   errorCode = "unsupported_grant_type"
+	codeInvalidClient          errorCode = "invalid_client"
+	codeResourceNotAllowed     errorCode = "resource_not_allowed"
+	codeAudienceRequired       errorCode = "audience_required"
+	codeAudienceNotAllowed     errorCode = "audience_not_allowed"
+	codeProjectNotAllowed      errorCode = "project_not_allowed"
+	codeBadHost                errorCode = "bad_host"
+	codeInvalidRequest         errorCode = "invalid_request"
+	codeBodyTooLarge           errorCode = "body_too_large"
+	codeNotAllowlisted         errorCode = "not_allowlisted"
+	codeMissingBearer          errorCode = "missing_bearer"
+	codeInvalidToken           errorCode = "invalid_token"
+	codeWrongDomain            errorCode = "wrong_domain"
+	codeRateLimited            errorCode = "rate_limited"
+	codeMintFailed             errorCode = "mint_failed"
+	codeUnauthorized           errorCode = "unauthorized"
+	codeNotFound               errorCode = "not_found"
+	codeMethodNotAllowed       errorCode = "method_not_allowed"
+	codeNotReady               errorCode = "not_ready"
+	codeOverloaded             errorCode = "overloaded"
+	codeInternal               errorCode = "internal_error"
+)
+
+// errorCodes is the published contract, in the order shown on "/".
+var errorCodes = []errorCode{
+	codeMissingUserAgent,
+	codeAmbiguousAuthorization,
+	codeCookieOriginNotAllowed,
+	codeUnknownIssuer,
+	codeShuttingDown,
+	codeEmailRequired,
+	codeEmailUnverified,
+	codeIDTokenExpiring,
+	codeIDTokenExpired,
+	codeIDTokenNotYetValid,
+	codeTokenReplayed,
+	codeGeoBlocked,
+	codeDenied,
+	codeScopeRequired,
+	codeScopeNotAllowed,
+	codeScopeNotPermitted,
+	codeTooManyStreams,
+	codeUserinfoFailed,
+	codeUnsupportedGrantType,
+	codeInvalidClient,
+	codeResourceNotAllowed,
+	codeAudienceRequired,
+	codeAudienceNotAllowed,
+	codeProjectNotAllowed,
+	codeBadHost,
+	codeInvalidRequest,
+	codeBodyTooLarge,
+	codeNotAllowlisted,
+	codeMissingBearer,
+	codeInvalidToken,
+	codeWrongDomain,
+	codeRateLimited,
+	codeMintFailed,
+	codeUnauthorized,
+	codeNotFound,
+	codeMethodNotAllowed,
+	codeNotReady,
+	codeOverloaded,
+	codeInternal,
+}
+
+type errorResp struct {
+	Code    errorCode `json:"code"`
+	Error   string    `json:"error"`
+	Message string    `json:"message,omitempty"` // ERROR_COMPAT only
+}
+
+// errorCompat (ERROR_COMPAT, set once at startup) adds a flat "message"
+// string to error bodies for clients still reading the old plain text.
+var errorCompat bool
+
+// writeJSONError writes {"code": code, "error": msg}; msg defaults to the
+// code itself.
+func writeJSONError(w http.ResponseWriter, status int, code errorCode, msg string) {
+	if msg == "" {
+		msg = string(code)
+	}
+	resp := errorResp{Code: code, Error: msg}
+	if errorCompat {
+		resp.Message = msg
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// bodyTooLarge answers 413 when err is MAX_BODY_BYTES cutting the request
+// body short, and reports whether it did.
+func bodyTooLarge(w http.ResponseWriter, err error) bool {
+	var mbe *http.MaxBytesError
+	if !errors.As(err, &mbe) {
+		return false
+	}
+	writeJSONError(w, http.StatusRequestEntityTooLarge, codeBodyTooLarge, fmt.Sprintf("request body exceeds %d bytes", mbe.Limit))
+	return true
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// TestErrorCodesPublished checks the contract on "/": every declared code
+// is listed in errorCodes, and every writeJSONError call in the package
+// passes a declared code rather than an ad-hoc string.
+func TestErrorCodesPublished(t *testing.T) {
+	listed := make(map[errorCode]bool)
+	for _, c := range errorCodes {
+		if listed[c] {
+			t.Errorf("%s listed twice", c)
+		}
+		listed[c] = true
+	}
+
+	files, err := filepath.Glob("*.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fset := token.NewFileSet()
+	declared := make(map[string]bool)
+	var calls []*ast.CallExpr
+	for _, name := range files {
+		if strings.HasSuffix(name, "_test.go") {
+			continue
+		}
+		f, err := parser.ParseFile(fset, name, nil, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ast.Inspect(f, func(n ast.Node) bool {
+			switch n := n.(type) {
+			case *ast.ValueSpec:
+				if id, ok := n.Type.(*ast.Ident); ok && id.Name == "errorCode" {
+					for _, name := range n.Names {
+						declared[name.Name] = true
+					}
+				}
+			case *ast.CallExpr:
+				if id, ok := n.Fun.(*ast.Ident); ok && id.Name == "writeJSONError" {
+					calls = append(calls, n)
+				}
+			}
+			return true
+		})
+	}
+	if len(declared) != len(errorCodes) {
+		t.Errorf("%d errorCode constants declared, %d listed in errorCodes", len(declared), len(errorCodes))
+	}
+	if len(calls) == 0 {
+		t.Fatal("no writeJSONError calls found")
+	}
+	for _, call := range calls {
+		arg, ok := call.Args[2].(*ast.Ident)
+		switch {
+		case !ok:
+			t.Errorf("%s: writeJSONError code is not a declared constant", fset.Position(call.Pos()))
+		case strings.HasPrefix(arg.Name, "code") && arg.Name != "code" && !declared[arg.Name]:
+			t.Errorf("%s: %s is not a declared errorCode", fset.Position(call.Pos()), arg.Name)
+		}
+	}
+}
+
+// TestRootListsErrorCodes checks the discovery side of the contract: "/"
+// publishes exactly errorCodes, in order.
+func TestRootListsErrorCodes(t *testing.T) {
+	signer := newTestSigner(t, "k1")
+	s := newTestServer(t, testConfig(t, map[string]string{"ROOT_RESPONSE": "json"}), newFakeVerifier(signer), &fakeMinter{}, nil)
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	var root rootResp
+	if err := json.Unmarshal(rec.Body.Bytes(), &root); err != nil {
+		t.Fatalf("%d %s: %v", rec.Code, rec.Body, err)
+	}
+	if !slices.Equal(root.ErrorCodes, errorCodes) {
+		t.Errorf(`"/" lists %q, want %q`, root.ErrorCodes, errorCodes)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// ------- geo gate -------
+type geoRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+}
+
+type geoGate struct {
+	path    string
+	allowed map[string]bool
+	blocked map[string]bool
+	exempt  cidrList
+	db      atomic.Pointer[maxminddb.Reader]
+}
+
+// newGeoGate loads the MaxMind DB at path. With an allow-list, only listed
+// countries pass (public IPs missing from the DB are rejected); otherwise
+// only blocked countries are rejected.
+func newGeoGate(path string, allowed, blocked []string, exempt cidrList) (*geoGate, error) {
+	g := &geoGate{
+		path:    path,
+		allowed: countrySet(allowed),
+		blocked: countrySet(blocked),
+		exempt:  exempt,
+	}
+	if err := g.reload(); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// reload swaps in a fresh copy of the DB; in-flight lookups keep the old one.
+func (g *geoGate) reload() error {
+	buf, err := os.ReadFile(g.path)
+	if err != nil {
+		return fmt.Errorf("read geoip db: %w", err)
+	}
+	db, err := maxminddb.FromBytes(buf)
+	if err != nil {
+		return fmt.Errorf("open geoip db: %w", err)
+	}
+	g.db.Store(db)
+	return nil
+}
+
+// allow reports whether ipStr may mint. Callers with no usable address
+// (a unix socket request without X-Forwarded-For) and private, loopback and
+// link-local addresses have no country, so like INTERNAL_CIDRS they are
+// never geo gated; in-cluster probes and sidecars keep working with an
+// allow-list set.
+func (g *geoGate) allow(ipStr string) bool {
+	ip := net.ParseIP(ipStr)
+	if ip == nil || ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || g.exempt.contains(ip) {
+		return true
+	}
+	var rec geoRecord
+	if err := g.db.Load().Lookup(ip, &rec); err != nil {
+		return len(g.allowed) == 0
+	}
+	country := strings.ToUpper(rec.Country.ISOCode)
+	if g.blocked[country] {
+		return false
+	}
+	if len(g.allowed) > 0 {
+		return g.allowed[country]
+	}
+	return true
+}
+
+func countrySet(codes []string) map[string]bool {
+	set := make(map[string]bool, len(codes))
+	for _, c := range codes {
+		set[strings.ToUpper(c)] = true
+	}
+	return set
+}
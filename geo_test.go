@@ -0,0 +1,18 @@
+package main
+
+import "testing"
+
+func TestGeoGateExemptsAddressesWithoutCountry(t *testing.T) {
+	exempt, err := parseCIDRList([]string{"203.0.113.0/24"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// no DB loaded: any lookup would panic, so each of these must be
+	// decided before one
+	g := &geoGate{allowed: countrySet([]string{"US"}), blocked: countrySet(nil), exempt: exempt}
+	for _, ip := range []string{"", "not-an-ip", "10.1.2.3", "192.168.0.9", "127.0.0.1", "::1", "fe80::1", "fd00::5", "203.0.113.7"} {
+		if !g.allow(ip) {
+			t.Errorf("allow(%q) = false with an allow-list, want exempt", ip)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/jws"
+	"golang.org/x/oauth2/jwt"
+)
+
+// ------- identity (ID) tokens -------
+
+// keyIDTokenSource mints Google-signed ID tokens for audience with a service
+// account key: a self-signed assertion carrying target_audience is exchanged
+// at the key's token_uri, which answers with an id_token instead of an
+// access token.
+type keyIDTokenSource struct {
+	ctx      context.Context // carries the outbound HTTP client
+	conf     *jwt.Config
+	audience string
+}
+
+func (s *keyIDTokenSource) Token() (*oauth2.Token, error) {
+	key, err := parseSAKey(s.conf.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	assertion, err := jws.Encode(
+		&jws.Header{Algorithm: "RS256", Typ: "JWT", KeyID: s.conf.PrivateKeyID},
+		&jws.ClaimSet{
+			Iss:           s.conf.Email,
+			Aud:           s.conf.TokenURL,
+			Iat:           now.Unix(),
+			Exp:           now.Add(time.Hour).Unix(),
+			PrivateClaims: map[string]any{"target_audience": s.audience},
+		}, key)
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {assertion},
+	}
+	req, err := http.NewRequestWithContext(s.ctx, http.MethodPost, s.conf.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	var out struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := doIDTokenRequest(oauth2.NewClient(s.ctx, nil), req, &out); err != nil {
+		return nil, err
+	}
+	return idTokenToken(out.IDToken)
+}
+
+// iamIDTokenSource mints ID tokens as target through the IAM Credentials
+// generateIdToken API, authenticated by base, as impersonatedSource does
+// for access tokens.
+type iamIDTokenSource struct {
+	ctx      context.Context
+	base     oauth2.TokenSource
+	target   string
+	audience string
+}
+
+func (s *iamIDTokenSource) Token() (*oauth2.Token, error) {
+	body, err := json.Marshal(map[string]any{"audience": s.audience, "includeEmail": true})
+	if err != nil {
+		return nil, err
+	}
+	endpoint := iamCredentialsURL + url.PathEscape(s.target) + ":generateIdToken"
+	req, err := http.NewRequestWithContext(s.ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	var out struct {
+		Token string `json:"token"`
+	}
+	if err := doIDTokenRequest(oauth2.NewClient(s.ctx, s.base), req, &out); err != nil {
+		return nil, err
+	}
+	return idTokenToken(out.Token)
+}
+
+func doIDTokenRequest(client *http.Client, req *http.Request, out any) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	buf, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		// shaped like a token endpoint failure for retryableMintError
+		return &oauth2.RetrieveError{Response: resp, Body: buf}
+	}
+	if err := json.Unmarshal(buf, out); err != nil {
+		return fmt.Errorf("id token response: %w", err)
+	}
+	return nil
+}
+
+// idTokenToken wraps an ID token as an oauth2.Token expiring at its exp, so
+// oauth2.ReuseTokenSource caches it like an access token. Google signed it;
+// the payload is only read here, never trusted for anything else.
+func idTokenToken(raw string) (*oauth2.Token, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("id token response: not a JWT")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("id token payload: %w", err)
+	}
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.Exp == 0 {
+		return nil, errors.New("id token payload: no exp")
+	}
+	return &oauth2.Token{AccessToken: raw, TokenType: "Bearer", Expiry: time.Unix(claims.Exp, 0)}, nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeIDTokenEndpoint answers jwt-bearer exchanges with an unsigned ID token
+// for the assertion's target_audience, expiring in an hour.
+func fakeIDTokenEndpoint(t *testing.T, mints *int) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		parts := strings.Split(r.PostForm.Get("assertion"), ".")
+		payload, _ := base64.RawURLEncoding.DecodeString(parts[1])
+		var claims struct {
+			Aud      string `json:"target_audience"`
+			Iss      string `json:"iss"`
+			TokenURL string `json:"aud"`
+		}
+		_ = json.Unmarshal(payload, &claims)
+		if claims.Aud == "" || claims.Iss != "broker@project.iam.gserviceaccount.com" {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		*mints++
+		body, _ := json.Marshal(map[string]any{"aud": claims.Aud, "exp": time.Now().Add(time.Hour).Unix()})
+		idTok := "e30." + base64.RawURLEncoding.EncodeToString(body) + ".sig"
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]string{"id_token": idTok})
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestIDTokenTokenAudience(t *testing.T) {
+	signer := newTestSigner(t, "k1")
+	s := newTestServer(t, testConfig(t, map[string]string{
+		"ID_TOKEN_AUDIENCES": "https://svc.a.run.app",
+		"OIDC_CLIENT_ID":     testClientID + ",privileged.apps.googleusercontent.com",
+		"TOKEN_AUDIENCE":     "privileged.apps.googleusercontent.com",
+	}), newFakeVerifier(signer), &fakeMinter{}, nil)
+	req := httptest.NewRequest(http.MethodGet, "/idtoken?audience=https://svc.a.run.app", nil)
+	req.Header.Set("Authorization", "Bearer "+signer.sign(t, idClaims(nil))) // aud: testClientID
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), `"code":"audience_not_allowed"`) {
+		t.Errorf("id token for a token outside TOKEN_AUDIENCE: %d %s, want 403 audience_not_allowed", rec.Code, rec.Body)
+	}
+}
+
+func TestIDTokenEndpoint(t *testing.T) {
+	var mints int
+	tokenSrv := fakeIDTokenEndpoint(t, &mints)
+	sources := newScopeSources(context.Background(), testSAJSON(t, newTestSigner(t, "sa").key, tokenSrv.URL))
+	signer := newTestSigner(t, "k1")
+	cfg := testConfig(t, map[string]string{"ID_TOKEN_AUDIENCES": "https://svc.a.run.app"})
+	s, err := newServer(cfg, newFakeVerifier(signer), &fakeMinter{}, sources, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.close)
+	get := func(query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/idtoken"+query, nil)
+		req.Header.Set("Authorization", "Bearer "+signer.sign(t, idClaims(nil)))
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for range 2 {
+		rec := get("?audience=https://svc.a.run.app")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+		}
+		var resp tokenResp
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		tok, err := idTokenToken(resp.AccessToken)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.TokenType != "Bearer" || resp.ExpiresIn < 3500 || time.Until(tok.Expiry) < 59*time.Minute {
+			t.Errorf("got %+v, expiring %s", resp, tok.Expiry)
+		}
+	}
+	if mints != 1 {
+		t.Errorf("%d mints for one audience, want the cached token reused", mints)
+	}
+
+	if rec := get("?audience=https://elsewhere.example"); rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), `"audience_not_allowed"`) {
+		t.Errorf("disallowed audience: %d %s", rec.Code, rec.Body)
+	}
+	if rec := get(""); rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), `"audience_required"`) {
+		t.Errorf("no audience: %d %s", rec.Code, rec.Body)
+	}
+}
+
+func TestIDTokenRejectsBadResponse(t *testing.T) {
+	if _, err := idTokenToken("not-a-jwt"); err == nil {
+		t.Error("accepted a non-JWT")
+	}
+	if _, err := idTokenToken("e30.e30.sig"); err == nil {
+		t.Error("accepted a token without exp")
+	}
+}
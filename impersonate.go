@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+// ------- service account impersonation -------
+
+const iamCredentialsURL = "https://iamcredentials.googleapis.com/v1/projects/-/serviceAccounts/"
+
+// impersonatedSource mints tokens for target through the IAM Credentials
+// generateAccessToken API, authenticating with base (Application Default
+// Credentials). The ADC principal needs roles/iam.serviceAccountTokenCreator
+// on target; no key for target ever reaches the broker.
+type impersonatedSource struct {
+	ctx      context.Context // carries the outbound HTTP client
+	base     oauth2.TokenSource
+	target   string
+	scopes   []string
+	lifetime time.Duration
+}
+
+type generateAccessTokenReq struct {
+	Scope    []string `json:"scope"`
+	Lifetime string   `json:"lifetime"`
+}
+
+type generateAccessTokenResp struct {
+	AccessToken string    `json:"accessToken"`
+	ExpireTime  time.Time `json:"expireTime"`
+}
+
+func (s *impersonatedSource) Token() (*oauth2.Token, error) {
+	body, err := json.Marshal(generateAccessTokenReq{
+		Scope:    s.scopes,
+		Lifetime: fmt.Sprintf("%ds", int(s.lifetime.Seconds())),
+	})
+	if err != nil {
+		return nil, err
+	}
+	endpoint := iamCredentialsURL + url.PathEscape(s.target) + ":generateAccessToken"
+	req, err := http.NewRequestWithContext(s.ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := oauth2.NewClient(s.ctx, s.base).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	buf, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		// Shaped like a token endpoint failure so retryableMintError treats
+		// 5xx/429 as transient and permission errors as final.
+		return nil, &oauth2.RetrieveError{Response: resp, Body: buf}
+	}
+	var out generateAccessTokenResp
+	if err := json.Unmarshal(buf, &out); err != nil {
+		return nil, fmt.Errorf("generateAccessToken: %w", err)
+	}
+	return &oauth2.Token{AccessToken: out.AccessToken, TokenType: "Bearer", Expiry: out.ExpireTime}, nil
+}
+
+// defaultCredentials returns the ADC token source used to call the IAM
+// Credentials API, failing fast when none are configured.
+func defaultCredentials(ctx context.Context) (oauth2.TokenSource, error) {
+	creds, err := google.FindDefaultCredentials(ctx, "https://www.googleapis.com/auth/cloud-platform")
+	if err != nil {
+		return nil, err
+	}
+	return creds.TokenSource, nil
+}
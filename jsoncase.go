@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"strings"
+)
+
+// ------- response field naming -------
+
+// responseCase selects the JSON key style for token and identity bodies.
+// Structs carry the OAuth snake_case tags; camel rewrites the keys on the way
+// out so there is only one set of tags to maintain.
+type responseCase string
+
+const (
+	caseSnake responseCase = "snake"
+	caseCamel responseCase = "camel"
+)
+
+func (c responseCase) marshal(v any) ([]byte, error) {
+	buf, err := json.Marshal(v)
+	if err != nil || c != caseCamel {
+		return buf, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	dec.UseNumber()
+	var generic any
+	if err := dec.Decode(&generic); err != nil {
+		return nil, err
+	}
+	return json.Marshal(camelKeys(generic))
+}
+
+// encode writes v followed by a newline, like json.Encoder.
+func (c responseCase) encode(w io.Writer, v any) error {
+	buf, err := c.marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(buf, '\n'))
+	return err
+}
+
+func camelKeys(v any) any {
+	switch t := v.(type) {
+	case map[string]any:
+		out := make(map[string]any, len(t))
+		for k, val := range t {
+			out[snakeToCamel(k)] = camelKeys(val)
+		}
+		return out
+	case []any:
+		for i := range t {
+			t[i] = camelKeys(t[i])
+		}
+		return t
+	}
+	return v
+}
+
+// snakeToCamel maps "access_token" to "accessToken".
+func snakeToCamel(s string) string {
+	parts := strings.Split(s, "_")
+	for i := 1; i < len(parts); i++ {
+		if p := parts[i]; p != "" {
+			parts[i] = strings.ToUpper(p[:1]) + p[1:]
+		}
+	}
+	return strings.Join(parts, "")
+}
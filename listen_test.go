@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestListenUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "broker.sock")
+
+	// a socket left behind by a crashed run
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	ln, err := listen("unix", path, 0o600)
+	if err != nil {
+		t.Fatalf("listen over a stale socket: %v", err)
+	}
+	defer ln.Close()
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fi.Mode().Perm(); got != 0o600 {
+		t.Errorf("socket mode = %o, want 600", got)
+	}
+
+	// a live socket is never taken over
+	if _, err := listen("unix", path, 0o600); err == nil || !strings.Contains(err.Error(), "in use") {
+		t.Errorf("listen on a live socket: err = %v", err)
+	}
+
+	file := filepath.Join(t.TempDir(), "not-a-socket")
+	if err := os.WriteFile(file, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := listen("unix", file, 0o600); err == nil {
+		t.Error("listen replaced a regular file")
+	}
+	if _, err := os.Stat(file); err != nil {
+		t.Errorf("regular file removed: %v", err)
+	}
+}
+
+func TestStreamOutlivesWriteTimeout(t *testing.T) {
+	signer := newTestSigner(t, "k1")
+	cfg := testConfig(t, map[string]string{"ENABLE_TOKEN_STREAM": "true", "WRITE_TIMEOUT": "100ms"})
+	s := newTestServer(t, cfg, newFakeVerifier(signer), &fakeMinter{}, nil)
+	ts := httptest.NewUnstartedServer(s)
+	ts.Config = newHTTPServer(cfg, s)
+	ts.Start()
+	defer ts.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+"/token/stream", nil)
+	req.Header.Set("Authorization", "Bearer "+signer.sign(t, idClaims(nil)))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	events := bufio.NewScanner(resp.Body)
+	next := func() string {
+		for events.Scan() {
+			if ev, ok := strings.CutPrefix(events.Text(), "event: "); ok {
+				return ev
+			}
+		}
+		return "error: " + fmt.Sprint(events.Err())
+	}
+	if ev := next(); ev != "token" {
+		t.Fatalf("first event = %q", ev)
+	}
+
+	// past WRITE_TIMEOUT the stream can still be written to
+	time.Sleep(300 * time.Millisecond)
+	s.drain()
+	if ev := next(); ev != "end" {
+		t.Errorf("event after WRITE_TIMEOUT = %q, want end", ev)
+	}
+}
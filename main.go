@@ -2,116 +2,351 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
+	"log/slog"
 	"math"
+	"mime"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/coreos/go-oidc/v3/oidc"
-	"golang.org/x/oauth2/google"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/oauth2"
 	"golang.org/x/time/rate"
 )
 
 type tokenResp struct {
+	AccessToken   string `json:"access_token"`
+	TokenType     string `json:"token_type"`
+	ExpiresIn     int    `json:"expires_in"`
+	Scope         string `json:"scope,omitempty"`
+	ScopeVerified *bool  `json:"scope_verified,omitempty"` // set with ?verify=1
+}
+
+type scopedTokenResp struct {
+	Scope       string `json:"scope"`
 	AccessToken string `json:"access_token"`
 	TokenType   string `json:"token_type"`
 	ExpiresIn   int    `json:"expires_in"`
+	Fingerprint string `json:"fingerprint"`
 }
 
-type whoamiResp struct {
-	Subject string `json:"sub"`
-	Email   string `json:"email,omitempty"`
-	Name    string `json:"name,omitempty"`
-	Picture string `json:"picture,omitempty"`
-	HD      string `json:"hd,omitempty"`
-	Issuer  string `json:"iss"`
-	Aud     string `json:"aud"`
-	Exp     int64  `json:"exp"`
+// mintCaller is a request that passed every pre-mint check.
+type mintCaller struct {
+	ip     string
+	claims whoamiResp
+	tr     *reqTrace
+
+	// the verified ID token, for the replay guard
+	idToken  string
+	idExpiry time.Time
 }
 
-// ------- env helpers -------
-func mustEnv(key string) string {
-	v := strings.TrimSpace(os.Getenv(key))
-	if v == "" {
-		log.Fatalf("missing required env var %s", key)
-	}
-	return v
+// tokenIntrospectResp is what /token would mint for the caller, without
+// minting it.
+type tokenIntrospectResp struct {
+	Scope          string `json:"scope"`
+	ExpiresIn      int    `json:"expires_in"`
+	ServiceAccount string `json:"service_account"`
+	Resource       string `json:"resource,omitempty"`
+	CacheEnabled   bool   `json:"cache_enabled"`
 }
-func getEnv(key, def string) string {
-	if v := strings.TrimSpace(os.Getenv(key)); v != "" {
-		return v
-	}
-	return def
+
+// introspectResp is {"active": false} or the token's claims plus active.
+type introspectResp struct {
+	Active bool `json:"active"`
+	*whoamiResp
 }
-func getEnvInt(key string, def int) int {
-	v := strings.TrimSpace(os.Getenv(key))
-	if v == "" {
-		return def
-	}
-	i, err := strconv.Atoi(v)
-	if err != nil {
-		return def
-	}
-	return i
+
+type rootResp struct {
+	Service    string      `json:"service"`
+	Endpoints  []string    `json:"endpoints"`
+	ErrorCodes []errorCode `json:"error_codes"`
+}
+
+type whoamiResp struct {
+	Subject       string `json:"sub"`
+	Email         string `json:"email,omitempty"`
+	EmailVerified bool   `json:"email_verified,omitempty"`
+	Name          string `json:"name,omitempty"`
+	Picture       string `json:"picture,omitempty"`
+	HD            string `json:"hd,omitempty"`
+	Issuer        string `json:"iss"`
+	Aud           string `json:"aud"`
+	Exp           int64  `json:"exp"`
 }
 
 // ------- simple limiter registry -------
 type limiterEntry struct {
 	lim  *rate.Limiter
 	last time.Time
+	gen  uint64 // overrides generation the limits were taken from
+	warm bool   // limits were loosened by enforcement warmup
+	// strikes counts consecutive rejections, for escalating Retry-After
+	strikes int
+	// with a shared limiter, the balance Redis last reported and when
+	sharedTokens float64
+	sharedAt     time.Time
 }
 type limiterRegistry struct {
-	mu    sync.Mutex
-	data  map[string]*limiterEntry
-	rps   rate.Limit
-	burst int
-	ttl   time.Duration
+	mu        sync.Mutex
+	data      map[string]*limiterEntry
+	rps       rate.Limit
+	burst     int
+	cold      int // tokens a new entry starts with; <0 means a full burst
+	ttl       time.Duration
+	overrides *limiterOverrides
+	warmup    *enforcementWarmup
+	escalate  retryEscalation
+	// shared, when set, charges buckets in Redis under sharedName; the
+	// local buckets are then only used by the "local" fallback.
+	shared     *redisLimiter
+	sharedName string
+}
+
+// routeLimiters is the per-user and per-IP registry pair a route charges.
+type routeLimiters struct {
+	user, ip *limiterRegistry
 }
 
-func newLimiterRegistry(perMin, burst, cleanupMins int) *limiterRegistry {
+// allowIP charges the per-IP limiter. A request with no client IP (over a
+// unix socket without X-Forwarded-For) has nothing to key on and passes.
+func (rl routeLimiters) allowIP(ip string) (bool, time.Duration) {
+	if ip == "" {
+		return true, 0
+	}
+	return rl.ip.allow("ip:" + ip)
+}
+
+// retryEscalation grows Retry-After for keys that keep hitting the limit:
+// the nth consecutive rejection waits factor^(n-1) times longer, up to max.
+// A factor of 1 or less keeps the plain delay.
+type retryEscalation struct {
+	factor float64
+	max    time.Duration
+}
+
+func (e retryEscalation) apply(delay time.Duration, strikes int) time.Duration {
+	if e.factor <= 1 || strikes <= 1 {
+		return delay
+	}
+	d := float64(delay) * math.Pow(e.factor, float64(strikes-1))
+	if d > float64(e.max) {
+		return max(e.max, delay)
+	}
+	return time.Duration(d)
+}
+
+func newLimiterRegistry(perMin, burst, cold, cleanupMins int, overrides *limiterOverrides) *limiterRegistry {
 	rps := rate.Limit(float64(perMin) / 60.0)
 	return &limiterRegistry{
-		data:  make(map[string]*limiterEntry),
-		rps:   rps,
-		burst: burst,
-		ttl:   time.Duration(cleanupMins) * time.Minute,
+		data:      make(map[string]*limiterEntry),
+		rps:       rps,
+		burst:     burst,
+		cold:      cold,
+		ttl:       time.Duration(cleanupMins) * time.Minute,
+		overrides: overrides,
+	}
+}
+
+// limitsFor returns the rate and burst for key, honoring overrides and
+// scaled by any enforcement warmup in progress.
+func (lr *limiterRegistry) limitsFor(key string) (rate.Limit, int, uint64) {
+	rps, burst := lr.rps, lr.burst
+	ov, ok, gen := lr.overrides.lookup(key)
+	if ok {
+		rps, burst = ov.limit(), ov.Burst
 	}
+	s := lr.warmup.scale(time.Now())
+	return rate.Limit(float64(rps) * s), scaleBurst(burst, s), gen
 }
 
 func (lr *limiterRegistry) allow(key string) (bool, time.Duration) {
+	return lr.allowN(key, 1)
+}
+
+// share moves lr's buckets to Redis under name; a nil s keeps them local.
+func (lr *limiterRegistry) share(s *redisLimiter, name string) {
+	lr.shared, lr.sharedName = s, name
+}
+
+// allowN charges n tokens at once; requests costing more than the burst never pass.
+func (lr *limiterRegistry) allowN(key string, n int) (bool, time.Duration) {
+	if lr.shared != nil {
+		ok, retry, err := lr.allowShared(key, n)
+		if err == nil {
+			return ok, retry
+		}
+		redisFallbacks.WithLabelValues(lr.shared.fallback).Inc()
+		switch lr.shared.fallback {
+		case fallbackFailOpen:
+			return true, 0
+		case fallbackFailClosed:
+			return false, time.Second
+		}
+	}
+	now := time.Now()
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+	entry := lr.entryLocked(key, now)
+	ok := entry.lim.AllowN(now, n)
+	if ok {
+		entry.strikes = 0
+		return true, 0
+	}
+	entry.strikes++
+	delay, ok := waitFor(entry.lim, now, n)
+	if !ok {
+		return false, lr.escalate.apply(5*time.Second, entry.strikes)
+	}
+	return false, lr.escalate.apply(delay, entry.strikes)
+}
+
+// waitFor is how long from now until lim has n tokens, read from its
+// balance rather than a reserve/cancel pair so a rejection never touches
+// the bucket. ok is false if n tokens will never be available.
+func waitFor(lim *rate.Limiter, now time.Time, n int) (time.Duration, bool) {
+	rps := lim.Limit()
+	if n > lim.Burst() || rps <= 0 {
+		return 0, false
+	}
+	missing := float64(n) - lim.TokensAt(now)
+	if missing <= 0 || rps == rate.Inf {
+		return 0, true
+	}
+	return time.Duration(missing / float64(rps) * float64(time.Second)), true
+}
+
+// allowShared charges key in Redis. The call is made without holding lr.mu;
+// the local entry only records the outcome (strikes, balance, last use).
+func (lr *limiterRegistry) allowShared(key string, n int) (bool, time.Duration, error) {
+	rps, burst, _ := lr.limitsFor(key)
+	cold := lr.cold
+	if cold < 0 || cold > burst {
+		cold = burst
+	}
+	ok, tokens, wait, err := lr.shared.take(lr.sharedName+":"+key, n, rps, burst, cold)
+	if err != nil {
+		return false, 0, err
+	}
 	now := time.Now()
 	lr.mu.Lock()
 	defer lr.mu.Unlock()
+	entry := lr.entryLocked(key, now)
+	entry.sharedTokens, entry.sharedAt = tokens, now
+	if ok {
+		entry.strikes = 0
+		return true, 0, nil
+	}
+	entry.strikes++
+	if wait < 0 {
+		wait = 5 * time.Second
+	}
+	return false, lr.escalate.apply(wait, entry.strikes), nil
+}
 
+// entryLocked returns key's entry, creating it or re-applying its limits as
+// needed, stamped with now. lr.mu must be held.
+func (lr *limiterRegistry) entryLocked(key string, now time.Time) *limiterEntry {
 	entry, ok := lr.data[key]
 	if !ok {
+		rps, burst, gen := lr.limitsFor(key)
 		entry = &limiterEntry{
-			lim:  rate.NewLimiter(lr.rps, lr.burst),
+			lim:  rate.NewLimiter(rps, burst),
 			last: now,
+			gen:  gen,
+			warm: lr.warmup.scale(now) > 1,
+		}
+		// cold start: drain down to the configured initial allowance
+		if lr.cold >= 0 && lr.cold < burst {
+			entry.lim.AllowN(now, burst-lr.cold)
 		}
 		lr.data[key] = entry
+	} else if entry.warm || (lr.overrides != nil && entry.gen != lr.overrides.generation()) {
+		// overrides were reloaded or warmup is tightening; re-apply limits
+		rps, burst, gen := lr.limitsFor(key)
+		entry.lim.SetLimitAt(now, rps)
+		entry.lim.SetBurstAt(now, burst)
+		entry.gen = gen
+		entry.warm = lr.warmup.scale(now) > 1
 	}
 	entry.last = now
-	ok = entry.lim.Allow()
+	return entry
+}
+
+// tokensLocked is entry's balance at now: while Redis is in use, the one it
+// last reported, refilled since; otherwise the local bucket's. lr.mu must
+// be held.
+func (lr *limiterRegistry) tokensLocked(entry *limiterEntry, now time.Time) float64 {
+	if lr.shared != nil && !lr.shared.down.Load() && !entry.sharedAt.IsZero() {
+		refill := now.Sub(entry.sharedAt).Seconds() * float64(entry.lim.Limit())
+		return min(float64(entry.lim.Burst()), entry.sharedTokens+refill)
+	}
+	return entry.lim.TokensAt(now)
+}
+
+// remaining is the whole number of tokens key could spend right now.
+func (lr *limiterRegistry) remaining(key string) int {
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+	entry, ok := lr.data[key]
+	if !ok {
+		_, burst, _ := lr.limitsFor(key)
+		return burst
+	}
+	return max(int(lr.tokensLocked(entry, time.Now())), 0)
+}
+
+// state is key's burst, whole tokens left, and time until the bucket is
+// full again, for the RateLimit-* headers.
+func (lr *limiterRegistry) state(key string) (limit, remaining int, reset time.Duration) {
+	rps, burst, _ := lr.limitsFor(key)
+	lr.mu.Lock()
+	entry, ok := lr.data[key]
+	var tokens float64
 	if ok {
-		return true, 0
+		tokens = lr.tokensLocked(entry, time.Now())
+	}
+	lr.mu.Unlock()
+	if !ok {
+		return burst, burst, 0
 	}
-	// compute retry-after ~ next allowed reservation
-	res := entry.lim.ReserveN(now, 1)
-	if !res.OK() {
-		return false, 5 * time.Second
+	if missing := float64(burst) - tokens; missing > 0 && rps > 0 {
+		reset = time.Duration(missing / float64(rps) * float64(time.Second))
+	}
+	return burst, max(int(tokens), 0), reset
+}
+
+// ratePolicy is a caller's effective limits as reported by /ratelimit.
+type ratePolicy struct {
+	Tier      string  `json:"tier"` // "default" or "override"
+	PerMin    float64 `json:"per_min"`
+	Burst     int     `json:"burst"`
+	Remaining int     `json:"remaining"`
+}
+
+func (lr *limiterRegistry) policy(key string) ratePolicy {
+	_, isOverride, _ := lr.overrides.lookup(key)
+	rps, burst, _ := lr.limitsFor(key)
+	p := ratePolicy{Tier: "default", PerMin: float64(rps) * 60, Burst: burst, Remaining: lr.remaining(key)}
+	if isOverride {
+		p.Tier = "override"
 	}
-	delay := res.DelayFrom(now)
-	// We consumed a token reservation; cancel to avoid skew
-	res.CancelAt(now)
-	return false, delay
+	return p
 }
 
 func (lr *limiterRegistry) cleanupLoop(ctx context.Context) {
@@ -122,25 +357,115 @@ func (lr *limiterRegistry) cleanupLoop(ctx context.Context) {
 		case <-ctx.Done():
 			return
 		case <-t.C:
-			cut := time.Now().Add(-lr.ttl)
-			lr.mu.Lock()
-			for k, v := range lr.data {
-				if v.last.Before(cut) {
-					delete(lr.data, k)
-				}
-			}
-			lr.mu.Unlock()
+			lr.sweep(time.Now().Add(-lr.ttl))
+		}
+	}
+}
+
+// sweep evicts entries idle since before cut. It holds the same lock as
+// allowN, which stamps last before charging, so a key in use is never
+// evicted between being read and being charged, and an evicted key simply
+// starts over on its next request.
+func (lr *limiterRegistry) sweep(cut time.Time) {
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+	for k, v := range lr.data {
+		if v.last.Before(cut) {
+			delete(lr.data, k)
 		}
 	}
 }
 
 // ------- ip helper -------
-func clientIP(r *http.Request) string {
+
+// ipExtractor finds the client address. With trusted set, X-Forwarded-For is
+// only believed from a trusted peer and is walked from the right past
+// trusted proxies. With hops set, it trusts exactly that many proxies in
+// front of the broker, each of which appends the address it saw, so the
+// client is hops entries from the right of X-Forwarded-For.
+type ipExtractor struct {
+	trusted cidrList
+	hops    int
+	unix    bool // listening on a unix socket: the peer has no address
+}
+
+func (x ipExtractor) clientIP(r *http.Request) string {
+	xff := r.Header.Get("X-Forwarded-For")
+	if x.unix {
+		return x.fromSocket(r, xff)
+	}
+	if len(x.trusted) > 0 {
+		return x.fromTrusted(r, xff)
+	}
+	if x.hops > 0 {
+		return x.fromHops(r, xff)
+	}
 	// Respect X-Forwarded-For from Render's proxy
-	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+	if xff != "" {
 		parts := strings.Split(xff, ",")
 		return strings.TrimSpace(parts[0])
 	}
+	return remoteHost(r)
+}
+
+// fromHops picks the entry appended by the outermost trusted proxy. A chain
+// shorter than hops means the request skipped part of the expected topology;
+// it is counted and the leftmost entry (or the peer address) is used.
+func (x ipExtractor) fromHops(r *http.Request, xff string) string {
+	var parts []string
+	for _, p := range strings.Split(xff, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			parts = append(parts, p)
+		}
+	}
+	if len(parts) < x.hops {
+		xffChainMismatch.Inc()
+		if len(parts) == 0 {
+			return remoteHost(r)
+		}
+		return parts[0]
+	}
+	return parts[len(parts)-x.hops]
+}
+
+// fromTrusted ignores X-Forwarded-For from untrusted peers, since anyone can
+// send one, and otherwise returns the rightmost entry that isn't a trusted
+// proxy. The leftmost entry is used if every hop is trusted.
+func (x ipExtractor) fromTrusted(r *http.Request, xff string) string {
+	peer := remoteHost(r)
+	if !x.trusted.contains(net.ParseIP(peer)) || xff == "" {
+		return peer
+	}
+	return x.rightmostUntrusted(xff)
+}
+
+func (x ipExtractor) rightmostUntrusted(xff string) string {
+	parts := strings.Split(xff, ",")
+	for i := len(parts) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(parts[i])
+		if ip := net.ParseIP(hop); ip == nil || !x.trusted.contains(ip) {
+			return hop
+		}
+	}
+	return strings.TrimSpace(parts[0])
+}
+
+// fromSocket reads the client from X-Forwarded-For alone: the peer on a unix
+// socket is the local proxy, so it is trusted by construction. Without the
+// header there is no client IP and "" is returned.
+func (x ipExtractor) fromSocket(r *http.Request, xff string) string {
+	switch {
+	case strings.TrimSpace(xff) == "":
+		return ""
+	case x.hops > 0:
+		return x.fromHops(r, xff)
+	case len(x.trusted) > 0:
+		return x.rightmostUntrusted(xff)
+	}
+	return strings.TrimSpace(strings.Split(xff, ",")[0])
+}
+
+func remoteHost(r *http.Request) string {
 	host, _, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
 		return r.RemoteAddr
@@ -148,6 +473,37 @@ func clientIP(r *http.Request) string {
 	return host
 }
 
+// cidrList holds networks parsed from env; bare IPs are treated as /32 or /128.
+type cidrList []*net.IPNet
+
+func parseCIDRList(vals []string) (cidrList, error) {
+	var out cidrList
+	for _, v := range vals {
+		if !strings.Contains(v, "/") {
+			if ip := net.ParseIP(v); ip != nil && ip.To4() != nil {
+				v += "/32"
+			} else {
+				v += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, n)
+	}
+	return out, nil
+}
+
+func (l cidrList) contains(ip net.IP) bool {
+	for _, n := range l {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
 // ------- auth helpers -------
 func bearerFromAuthz(h string) (string, error) {
 	if !strings.HasPrefix(strings.ToLower(h), "bearer ") {
@@ -156,199 +512,1823 @@ func bearerFromAuthz(h string) (string, error) {
 	return strings.TrimSpace(h[len("bearer "):]), nil
 }
 
-func enableCORS(w http.ResponseWriter, origin string) {
-	w.Header().Set("Access-Control-Allow-Origin", origin)
-	w.Header().Set("Access-Control-Allow-Headers", "authorization, content-type")
-	w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+var errAmbiguousAuthz = errors.New("ambiguous authorization")
+
+// authorizationHeader returns the request's Authorization value. Multiple
+// headers, or one a proxy merged into a comma list, are rejected unless
+// allowDuplicate is set, in which case the first value wins.
+func authorizationHeader(r *http.Request, allowDuplicate bool) (string, error) {
+	vals := r.Header.Values("Authorization")
+	if len(vals) == 0 {
+		return "", nil
+	}
+	if !allowDuplicate && (len(vals) > 1 || strings.Contains(vals[0], ",")) {
+		return "", errAmbiguousAuthz
+	}
+	first, _, _ := strings.Cut(vals[0], ",")
+	return first, nil
+}
+
+// emailPolicyError returns the rejection code for claims failing the email
+// requirements, or "" when they pass. Requiring a verified email implies
+// requiring an email.
+func emailPolicyError(c whoamiResp, requireEmail, requireVerified bool) errorCode {
+	if (requireEmail || requireVerified) && strings.TrimSpace(c.Email) == "" {
+		return codeEmailRequired
+	}
+	if requireVerified && !c.EmailVerified {
+		return codeEmailUnverified
+	}
+	return ""
 }
 
-// ------- main -------
-func main() {
-	// Required
-	saJSON := []byte(mustEnv("GOOGLE_SA_JSON"))
-	oidcClientID := mustEnv("OIDC_CLIENT_ID")
-
-	// Optional
-	scope := getEnv("TOKEN_SCOPE", "https://www.googleapis.com/auth/cloud-platform")
-	corsOrigin := getEnv("CORS_ORIGIN", "*")
-	allowedHD := strings.TrimSpace(os.Getenv("ALLOWED_HD"))
-
-	// Rate config
-	userPerMin := getEnvInt("RATE_PER_MIN", 60)
-	userBurst := getEnvInt("RATE_BURST", 30)
-	ipPerMin := getEnvInt("IP_RATE_PER_MIN", 120)
-	ipBurst := getEnvInt("IP_BURST", 60)
-	cleanupMins := getEnvInt("RATE_CLEANUP_MINS", 30)
+// emailMatch is the policy for comparing emails in allow-lists and traces.
+// Domains are always case-insensitive. The local part is case-sensitive per
+// RFC 5321, but Google treats it case-insensitively, so "ci" is the default.
+type emailMatch string
 
-	// Registries
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-	userRL := newLimiterRegistry(userPerMin, userBurst, cleanupMins)
-	ipRL := newLimiterRegistry(ipPerMin, ipBurst, cleanupMins)
-	go userRL.cleanupLoop(ctx)
-	go ipRL.cleanupLoop(ctx)
-
-	// SA token source
-	jwtConf, err := google.JWTConfigFromJSON(saJSON, scope)
-	if err != nil {
-		log.Fatalf("JWTConfigFromJSON: %v", err)
+const (
+	emailMatchCI emailMatch = "ci"
+	emailMatchCS emailMatch = "cs"
+)
+
+func parseEmailMatch(v string) (emailMatch, error) {
+	switch m := emailMatch(strings.ToLower(v)); m {
+	case emailMatchCI, emailMatchCS:
+		return m, nil
 	}
+	return "", fmt.Errorf("must be ci or cs, got %q", v)
+}
+
+// normalize returns the form of email used for comparisons under m.
+func (m emailMatch) normalize(email string) string {
+	email = strings.TrimSpace(email)
+	at := strings.LastIndex(email, "@")
+	if at < 0 || m == emailMatchCI {
+		return strings.ToLower(email)
+	}
+	return email[:at] + strings.ToLower(email[at:])
+}
 
-	// OIDC verifier
-	provider, err := oidc.NewProvider(ctx, "https://accounts.google.com")
+// adminAuthorized checks the admin bearer token in constant time.
+func adminAuthorized(r *http.Request, adminToken string) bool {
+	authz, err := authorizationHeader(r, false)
 	if err != nil {
-		log.Fatalf("oidc.NewProvider: %v", err)
+		return false
 	}
-	verifier := provider.Verifier(&oidc.Config{ClientID: oidcClientID})
+	raw, err := bearerFromAuthz(authz)
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(raw), []byte(adminToken)) == 1
+}
 
-	mux := http.NewServeMux()
+// ------- server -------
 
-	// Health
-	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		_, _ = w.Write([]byte("ok"))
-	})
+// TokenVerifier checks a raw ID token. issuerVerifier is the production
+// implementation; tests substitute their own.
+type TokenVerifier interface {
+	Verify(ctx context.Context, raw string) (*oidc.IDToken, error)
+	// VerifyAnyAudience skips the audience check (introspection only).
+	VerifyAnyAudience(ctx context.Context, raw string) (*oidc.IDToken, error)
+}
 
-	// whoami (ID token → claims)
-	mux.HandleFunc("/whoami", func(w http.ResponseWriter, r *http.Request) {
-		enableCORS(w, corsOrigin)
-		if r.Method == http.MethodOptions {
-			w.WriteHeader(http.StatusNoContent)
-			return
+// server is the broker's routes behind the top-level wrapper, plus the
+// background work they own. main builds the upstream pieces (verifier,
+// minter, per-scope sources, egress) and hands them in, so handlers can be
+// exercised with fakes.
+type server struct {
+	http.Handler
+	cfg        Config
+	cancel     context.CancelFunc
+	inFlight   *atomic.Int64
+	draining   *atomic.Bool
+	drainStart chan struct{} // closed when shutdown begins
+	audit      *auditLog
+	hook       *issuanceWebhook
+	redis      *redisLimiter
+}
+
+// drain marks the start of shutdown: streams end and /readyz fails.
+func (s *server) drain() {
+	s.draining.Store(true)
+	close(s.drainStart)
+}
+
+// close stops background work and flushes the audit log and webhook.
+func (s *server) close() {
+	s.cancel()
+	s.audit.close()
+	s.hook.close(s.cfg.WebhookTimeout)
+	s.redis.close()
+}
+
+// newServer wires every route from cfg. sources backs /idtoken; out carries
+// the outbound proxy for upstream calls.
+func newServer(cfg Config, verifier TokenVerifier, minter Minter, sources *scopeSources, out *egress) (_ *server, err error) {
+	ips := ipExtractor{trusted: cfg.TrustedProxies, hops: cfg.XFFTrustedHops, unix: cfg.ListenNetwork == "unix"}
+	tracing := cfg.OTelEndpoint != ""
+	if tracing {
+		verifier, minter = tracedVerifier{verifier}, tracedMinter{minter}
+	}
+	domains := newDomainLabels(append(cfg.MetricsDomains, cfg.AllowedHD))
+	lists := newAccessLists(cfg)
+
+	// Registries
+	ctx, cancel := context.WithCancel(context.Background())
+	defer func() {
+		if err != nil {
+			cancel()
 		}
-		if r.Method != http.MethodGet {
-			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
-			return
+	}()
+	var reloaders []reloader
+	var overrides *limiterOverrides
+	if path := cfg.LimiterOverridesFile; path != "" {
+		overrides, err = newLimiterOverrides(path)
+		if err != nil {
+			return nil, fmt.Errorf("limiter overrides: %w", err)
+		}
+		reloaders = append(reloaders, reloader{name: "limiter overrides", fn: overrides.reload})
+	}
+	// Shared limits across replicas (REDIS_URL); otherwise in-memory
+	var shared *redisLimiter
+	if cfg.RedisURL != "" {
+		client, err := parseRedisURL(cfg.RedisURL, cfg.RedisTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("REDIS_URL: %w", err)
+		}
+		shared = newRedisLimiter(client, cfg.RedisKeyPrefix+"rl:", cfg.RedisFallback)
+		if err := shared.ping(ctx); err != nil {
+			log.Printf("WARNING: redis unreachable at startup (%v); limiting with fallback %s until it is", err, cfg.RedisFallback)
+		}
+	}
+	// ID token replay protection, shared like the limits (optional)
+	var replays *replayGuard
+	if cfg.ReplayProtection {
+		replays = newReplayGuard(cfg.ReplayMaxUses, cfg.OIDCSkew, shared)
+		go replays.cleanupLoop(ctx)
+	}
+	esc := retryEscalation{factor: cfg.RetryAfterFactor, max: cfg.RetryAfterMax}
+	warm := newEnforcementWarmup(cfg.EnforcementWarmup, cfg.EnforcementWarmupFactor)
+	newRouteLimiters := func(prefix string, userPerMin, userBurst, ipPerMin, ipBurst int) routeLimiters {
+		rl := routeLimiters{
+			user: newLimiterRegistry(userPerMin, userBurst, cfg.LimiterColdTokens, cfg.CleanupMins, overrides),
+			ip:   newLimiterRegistry(ipPerMin, ipBurst, cfg.LimiterColdTokens, cfg.CleanupMins, overrides),
+		}
+		for name, lr := range map[string]*limiterRegistry{"user": rl.user, "ip": rl.ip} {
+			lr.share(shared, prefix+name)
+			lr.escalate, lr.warmup = esc, warm
+			go lr.cleanupLoop(ctx)
 		}
+		return rl
+	}
+	// /token and every route without its own limits keep the original Redis
+	// names, so their buckets survive an upgrade; /whoami gets its own pair
+	tokenRL := newRouteLimiters("", cfg.TokenPerMin, cfg.TokenBurst, cfg.TokenIPPerMin, cfg.TokenIPBurst)
+	whoamiRL := newRouteLimiters("whoami-", cfg.WhoamiPerMin, cfg.WhoamiBurst, cfg.WhoamiIPPerMin, cfg.WhoamiIPBurst)
 
-		// pre-verify IP limiter
-		ip := clientIP(r)
-		if ok, retry := ipRL.allow("ip:" + ip); !ok {
-			w.Header().Set("Retry-After", seconds(retry))
-			http.Error(w, "rate limit (ip)", http.StatusTooManyRequests)
-			return
+	// Geo gate (optional)
+	var geo *geoGate
+	if cfg.GeoIPDB != "" {
+		geo, err = newGeoGate(cfg.GeoIPDB, cfg.AllowedCountries, cfg.BlockedCountries, cfg.InternalNets)
+		if err != nil {
+			return nil, fmt.Errorf("geo gate: %w", err)
 		}
+		reloaders = append(reloaders, reloader{name: "geoip db", fn: geo.reload})
+	}
 
-		raw, err := bearerFromAuthz(r.Header.Get("Authorization"))
+	// Per-caller scope policy (optional)
+	var scopePol *scopePolicy
+	if path := cfg.ScopePolicyFile; path != "" {
+		scopePol, err = newScopePolicy(path, cfg.EmailMatch)
 		if err != nil {
-			http.Error(w, "missing or invalid Authorization header", http.StatusUnauthorized)
-			return
+			return nil, fmt.Errorf("scope policy: %w", err)
 		}
-		idTok, err := verifier.Verify(r.Context(), raw)
+		reloaders = append(reloaders, reloader{name: "scope policy", fn: scopePol.reload})
+	}
+	if len(lists.files()) > 0 {
+		reloaders = append(reloaders, reloader{name: "access lists", fn: lists.reload})
+		if cfg.AccessListsReloadInterval > 0 {
+			go lists.watch(ctx, cfg.AccessListsReloadInterval)
+		}
+	}
+	go reloadOnSIGHUP(ctx, reloaders)
+
+	// Resource access boundaries for ?resource= on /token (optional)
+	var downscopes downscopePolicy
+	if path := cfg.DownscopePolicyFile; path != "" {
+		downscopes, err = loadDownscopePolicy(path)
 		if err != nil {
-			http.Error(w, "invalid id token", http.StatusUnauthorized)
-			return
+			return nil, fmt.Errorf("downscope policy: %w", err)
 		}
+	}
 
-		// per-user limiter (after we know who they are)
-		var claims whoamiResp
-		_ = idTok.Claims(&claims)
-		if claims.Subject == "" {
-			http.Error(w, "no subject", http.StatusUnauthorized)
-			return
+	// Additional service accounts by ?project= or caller domain (optional)
+	var accounts *serviceAccounts
+	if cfg.ServiceAccountsFile != "" {
+		accounts, err = loadServiceAccounts(out.ctx(context.Background()), cfg, out)
+		if err != nil {
+			return nil, fmt.Errorf("service accounts: %w", err)
 		}
-		if ok, retry := userRL.allow("user:" + claims.Subject); !ok {
-			w.Header().Set("Retry-After", seconds(retry))
-			http.Error(w, "rate limit (user)", http.StatusTooManyRequests)
-			return
+		if tracing {
+			for _, a := range accounts.byName {
+				a.minter = tracedMinter{a.minter}
+			}
 		}
+	}
 
-		w.Header().Set("Cache-Control", "no-store")
-		w.Header().Set("Content-Type", "application/json")
-		_ = json.NewEncoder(w).Encode(claims)
-	})
+	// CORS only on browser-facing routes; admin routes never get it
+	cors := corsRoutes{
+		"/healthz":          routeCORS(cfg, "HEALTHZ"),
+		"/whoami":           routeCORS(cfg, "WHOAMI"),
+		"/token":            routeCORS(cfg, "TOKEN"),
+		"/token/batch":      routeCORS(cfg, "TOKEN"),
+		"/token/introspect": routeCORS(cfg, "TOKEN"),
+		"/ratelimit":        routeCORS(cfg, "RATELIMIT"),
+	}
 
-	// token (ID token → short-lived GCP access token)
-	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
-		enableCORS(w, corsOrigin)
-		if r.Method == http.MethodOptions {
-			w.WriteHeader(http.StatusNoContent)
-			return
-		}
-		if r.Method != http.MethodGet {
-			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
-			return
-		}
+	traces := newTraceRegistry(cfg.EmailMatch)
 
-		// pre-verify IP limiter
-		ip := clientIP(r)
-		if ok, retry := ipRL.allow("ip:" + ip); !ok {
-			w.Header().Set("Retry-After", seconds(retry))
-			http.Error(w, "rate limit (ip)", http.StatusTooManyRequests)
-			return
+	// Audit log (optional)
+	var audit *auditLog
+	if path := cfg.AuditLogFile; path != "" {
+		audit, err = newAuditLog(path, cfg.AuditBuffer, cfg.AuditOverflow)
+		if err != nil {
+			return nil, fmt.Errorf("audit log: %w", err)
 		}
+	}
+
+	// Issuance webhook for SIEM/alerting (optional)
+	var hook *issuanceWebhook
+	if cfg.WebhookURL != "" {
+		hook = newIssuanceWebhook(cfg.WebhookURL, []byte(cfg.WebhookSecret), cfg.WebhookBuffer, cfg.WebhookRetries, cfg.WebhookTimeout)
+	}
 
-		raw, err := bearerFromAuthz(r.Header.Get("Authorization"))
+	ready := &readiness{afterMint: cfg.ReadyAfterFirstMint, maxFailures: int64(cfg.ReadyMintFailures)}
+	minter = readyMinter{Minter: minter, rd: ready}
+	ready.probe = func() { warmupMint(ctx, minter, cfg.Scope) }
+
+	// Client credentials for non-interactive clients (optional)
+	var clients *clientRegistry
+	var clientRL *limiterRegistry
+	if path := cfg.ClientCredentialsFile; path != "" {
+		clients, err = loadClientRegistry(path)
 		if err != nil {
-			http.Error(w, "missing or invalid Authorization header", http.StatusUnauthorized)
-			return
+			return nil, fmt.Errorf("client credentials: %w", err)
+		}
+		clientRL = newLimiterRegistry(cfg.ClientPerMin, cfg.ClientBurst, cfg.LimiterColdTokens, cfg.CleanupMins, overrides)
+		clientRL.share(shared, "client")
+		go clientRL.cleanupLoop(ctx)
+	}
+
+	// verifyFailed maps a Verify error to a response. Cancellation that didn't
+	// come from the request itself, or any failure once shutdown has begun,
+	// is a 503 rather than a misleading 401.
+	var draining atomic.Bool
+	drainStart := make(chan struct{}) // closed when shutdown begins
+	verifyFailed := func(w http.ResponseWriter, r *http.Request, err error) {
+		slog.WarnContext(r.Context(), "oidc verification failed",
+			"request_id", requestIDOf(r.Context()), "route", routeOf(r), "reason", err.Error())
+		switch {
+		case draining.Load() || (errors.Is(err, context.Canceled) && r.Context().Err() == nil):
+			verifyFailures.WithLabelValues(string(codeShuttingDown)).Inc()
+			writeJSONError(w, http.StatusServiceUnavailable, codeShuttingDown, "")
+		case errors.Is(err, errUnknownIssuer):
+			verifyFailures.WithLabelValues(string(codeUnknownIssuer)).Inc()
+			writeJSONError(w, http.StatusUnauthorized, codeUnknownIssuer, "")
+		// a valid token from a client ROUTE_AUDIENCES keeps off this route
+		case errors.Is(err, errRouteAudience):
+			writeJSONError(w, http.StatusForbidden, codeAudienceNotAllowed, "audience not accepted on "+routeOf(r))
+		// time claims outside OIDC_SKEW_SECONDS: the signature was fine, so
+		// say so and give the server's clock for comparison
+		case errors.Is(err, errTokenExpired):
+			verifyFailures.WithLabelValues("expired").Inc()
+			writeJSONError(w, http.StatusUnauthorized, codeIDTokenExpired,
+				"id token expired; sign in again (server time "+time.Now().UTC().Format(time.RFC3339)+")")
+		case errors.Is(err, errTokenNotYetUsed):
+			verifyFailures.WithLabelValues("not_yet_valid").Inc()
+			writeJSONError(w, http.StatusUnauthorized, codeIDTokenNotYetValid,
+				"id token not valid yet; check the client clock (server time "+time.Now().UTC().Format(time.RFC3339)+")")
+		default:
+			verifyFailures.WithLabelValues("invalid").Inc()
+			writeJSONError(w, http.StatusUnauthorized, codeInvalidToken, "invalid id token")
 		}
+	}
+
+	// verifyForRoute verifies raw, then applies the route's ROUTE_AUDIENCES
+	// restriction, so e.g. /token can pin one audience while /whoami
+	// accepts every configured one.
+	verifyForRoute := func(r *http.Request, raw string) (*oidc.IDToken, error) {
 		idTok, err := verifier.Verify(r.Context(), raw)
 		if err != nil {
-			http.Error(w, "invalid id token", http.StatusUnauthorized)
-			return
+			return nil, err
 		}
-
-		// domain gate (optional)
-		if allowedHD != "" {
-			var c struct{ HD string `json:"hd"` }
-			_ = idTok.Claims(&c)
-			if strings.ToLower(strings.TrimSpace(c.HD)) != strings.ToLower(allowedHD) {
-				http.Error(w, "forbidden: wrong domain", http.StatusForbidden)
-				return
-			}
+		if !cfg.RouteAudiences.allows(routeOf(r), idTok.Audience) {
+			return nil, fmt.Errorf("%w: %s", errRouteAudience, routeOf(r))
 		}
+		return idTok, nil
+	}
 
-		// per-user limiter after identity known
-		var sub struct{ Sub string `json:"sub"` }
-		_ = idTok.Claims(&sub)
-		if sub.Sub == "" {
-			http.Error(w, "no subject", http.StatusUnauthorized)
+	routes := newRouteTable()
+	get, getHead, post := []string{http.MethodGet}, []string{http.MethodGet, http.MethodHead}, []string{http.MethodPost}
+
+	// Root (service identity; unauthenticated, not rate limited)
+	endpoints := []string{"/healthz", "/livez", "/readyz", "/version", "/whoami", "/token", "/token/introspect", "/token/batch", "/ratelimit"}
+	routes.handleFunc("/", get, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			writeJSONError(w, http.StatusNotFound, codeNotFound, "not found")
 			return
 		}
-		if ok, retry := userRL.allow("user:" + sub.Sub); !ok {
-			w.Header().Set("Retry-After", seconds(retry))
-			http.Error(w, "rate limit (user)", http.StatusTooManyRequests)
+		if cfg.RootResponse == "empty" {
+			w.WriteHeader(http.StatusNoContent)
 			return
 		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(rootResp{
+			Service:    "token-broker",
+			Endpoints:  endpoints,
+			ErrorCodes: errorCodes,
+		})
+	})
 
-		// mint short-lived GCP token
-		accessTok, err := jwtConf.TokenSource(r.Context()).Token()
-		if err != nil {
-			http.Error(w, "token mint failed", http.StatusInternalServerError)
+	// Liveness: 200 whenever the process can answer. /healthz predates
+	// /livez and stays an alias.
+	live := func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("ok"))
+	}
+	routes.handleFunc("/healthz", getHead, live)
+	routes.handleFunc("/livez", getHead, live)
+
+	// Build metadata, to confirm which revision a deploy is running
+	routes.handleFunc("/version", get, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(buildInfo())
+	})
+
+	// Readiness (READY_AFTER_FIRST_MINT holds it until a mint succeeds;
+	// READY_MINT_FAILURES drops it while minting keeps failing). With
+	// REDIS_URL the body reports Redis too, and REDIS_READYZ makes it a
+	// dependency.
+	routes.handleFunc("/readyz", getHead, func(w http.ResponseWriter, r *http.Request) {
+		if !ready.ready() || draining.Load() {
+			writeJSONError(w, http.StatusServiceUnavailable, codeNotReady, "not ready")
 			return
 		}
-		ttl := 3600
-		if !accessTok.Expiry.IsZero() {
-			if d := time.Until(accessTok.Expiry); d > 0 {
-				ttl = int(d.Seconds())
+		body := "ready"
+		if shared != nil {
+			if err := shared.ping(r.Context()); err != nil {
+				if cfg.RedisReadyz {
+					writeJSONError(w, http.StatusServiceUnavailable, codeNotReady, "not ready: redis unavailable")
+					return
+				}
+				body += "\nredis: unavailable (fallback " + cfg.RedisFallback + ")"
 			} else {
-				ttl = 0
+				body += "\nredis: ok"
 			}
 		}
-
-		w.Header().Set("Cache-Control", "no-store")
-		w.Header().Set("Content-Type", "application/json")
-		_ = json.NewEncoder(w).Encode(tokenResp{
-			AccessToken: accessTok.AccessToken,
-			TokenType:   accessTok.TokenType,
-			ExpiresIn:   ttl,
-		})
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte(body))
 	})
 
-	// Wrap with CORS for any future routes
-	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		enableCORS(w, corsOrigin)
-		if r.Method == http.MethodOptions {
-			w.WriteHeader(http.StatusNoContent)
+	// rateLimitHeaders sets the draft IETF RateLimit-* headers for a route's
+	// per-user limiter once a request has been charged (RATELIMIT_HEADERS).
+	rateLimitHeaders := func(w http.ResponseWriter, lr *limiterRegistry, key string) {
+		if !cfg.RatelimitHeaders {
+			return
+		}
+		limit, remaining, reset := lr.state(key)
+		w.Header().Set("RateLimit-Limit", strconv.Itoa(limit))
+		w.Header().Set("RateLimit-Remaining", strconv.Itoa(remaining))
+		w.Header().Set("RateLimit-Reset", strconv.Itoa(int(math.Ceil(reset.Seconds()))))
+	}
+
+	// Denylists are checked as early as each identity is known: banned IPs
+	// before any limiter or verification, banned subjects right after
+	// verification and before the user limiter, so neither spends budget.
+	ipDenied := func(w http.ResponseWriter, ip string) bool {
+		if !cfg.DenyIPs.contains(net.ParseIP(ip)) {
+			return false
+		}
+		deniedTotal.WithLabelValues("ip").Inc()
+		writeJSONError(w, http.StatusForbidden, codeDenied, "")
+		return true
+	}
+	// shadowed reports whether SHADOW_MODE puts gate in report-only mode, in
+	// which case the would-be rejection is logged and counted instead.
+	shadowed := func(gate string, c whoamiResp, tr *reqTrace) bool {
+		if !cfg.ShadowGates[gate] {
+			return false
+		}
+		tr.logf("shadow: would be rejected by %s", gate)
+		log.Printf("shadow rejection: gate=%s sub=%s email=%s hd=%s", gate, c.Subject, c.Email, c.HD)
+		shadowRejections.WithLabelValues(gate).Inc()
+		return true
+	}
+
+	subjectDenied := func(w http.ResponseWriter, c whoamiResp, tr *reqTrace) bool {
+		if !lists.load().denySubjects[c.Subject] || shadowed(gateDenySubjects, c, tr) {
+			return false
+		}
+		tr.logf("rejected by subject denylist")
+		deniedTotal.WithLabelValues("subject").Inc()
+		writeJSONError(w, http.StatusForbidden, codeDenied, "")
+		return true
+	}
+	// notAllowlisted enforces ALLOWED_SUBJECTS / ALLOWED_EMAILS when either is
+	// set: the caller must match one of them. Emails only count when verified.
+	notAllowlisted := func(w http.ResponseWriter, c whoamiResp, tr *reqTrace) bool {
+		al := lists.load()
+		if len(al.allowedSubjects) == 0 && len(al.allowedEmails) == 0 {
+			return false
+		}
+		if al.allowedSubjects[c.Subject] || (c.EmailVerified && al.allowedEmails[cfg.EmailMatch.normalize(c.Email)]) {
+			return false
+		}
+		if shadowed(gateAllowlist, c, tr) {
+			return false
+		}
+		tr.logf("rejected: not on the subject or email allow-list")
+		deniedTotal.WithLabelValues("allowlist").Inc()
+		writeJSONError(w, http.StatusForbidden, codeNotAllowlisted, "identity is not on the allow-list")
+		return true
+	}
+	// wrongDomain enforces ALLOWED_HD.
+	wrongDomain := func(w http.ResponseWriter, c whoamiResp, tr *reqTrace) bool {
+		al := lists.load()
+		if al.allowedHD == "" || strings.ToLower(strings.TrimSpace(c.HD)) == strings.ToLower(al.allowedHD) {
+			return false
+		}
+		if shadowed(gateDomain, c, tr) {
+			return false
+		}
+		tr.logf("rejected by domain gate")
+		writeJSONError(w, http.StatusForbidden, codeWrongDomain, al.wrongDomainMsg(cfg.DiscloseAllowedDomain))
+		return true
+	}
+
+	// userAgentOK records UA-less requests and, when REQUIRE_USER_AGENT is
+	// set, rejects them unless they come from an internal network.
+	userAgentOK := func(w http.ResponseWriter, r *http.Request, ip string) bool {
+		if r.UserAgent() != "" {
+			return true
+		}
+		missingUserAgent.WithLabelValues(routeOf(r)).Inc()
+		if !cfg.RequireUserAgent || cfg.InternalNets.contains(net.ParseIP(ip)) {
+			return true
+		}
+		writeJSONError(w, http.StatusBadRequest, codeMissingUserAgent, "")
+		return false
+	}
+
+	// bearer reads the caller's ID token from the Authorization header or,
+	// when that is absent, from the TOKEN_COOKIE_NAME cookie. A browser sends
+	// the cookie on cross-site requests too, so a cookie-borne token is only
+	// accepted from an origin on the route's CORS allow-list.
+	bearer := func(w http.ResponseWriter, r *http.Request) (string, bool) {
+		authz, err := authorizationHeader(r, cfg.AllowDuplicateAuthz)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, codeAmbiguousAuthorization, "")
+			return "", false
+		}
+		if authz == "" && cfg.TokenCookieName != "" {
+			if c, err := r.Cookie(cfg.TokenCookieName); err == nil && strings.TrimSpace(c.Value) != "" {
+				if origin := r.Header.Get("Origin"); origin != "" {
+					if p := cors.lookup(r.URL.Path); p == nil || p.any || p.allowOrigin(origin) == "" {
+						writeJSONError(w, http.StatusForbidden, codeCookieOriginNotAllowed, "")
+						return "", false
+					}
+				}
+				return strings.TrimSpace(c.Value), true
+			}
+		}
+		raw, err := bearerFromAuthz(authz)
+		if err != nil {
+			writeJSONError(w, http.StatusUnauthorized, codeMissingBearer, "missing or invalid Authorization header")
+			return "", false
+		}
+		return raw, true
+	}
+
+	// whoami (ID token → claims)
+	routes.handleFunc("/whoami", get, func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		cors.lookup("/whoami").apply(w, r)
+
+		// pre-verify IP denylist and limiter
+		ip := ips.clientIP(r)
+		if ipDenied(w, ip) {
+			return
+		}
+		if ok, retry := whoamiRL.allowIP(ip); !ok {
+			rateLimited.WithLabelValues("ip", domainUnknown).Inc()
+			w.Header().Set("Retry-After", seconds(retry))
+			writeJSONError(w, http.StatusTooManyRequests, codeRateLimited, "rate limit (ip)")
+			return
+		}
+		if !userAgentOK(w, r, ip) {
+			return
+		}
+
+		raw, ok := bearer(w, r)
+		if !ok {
+			return
+		}
+		verifyStart := time.Now()
+		idTok, err := verifyForRoute(r, raw)
+		if err != nil {
+			verifyFailed(w, r, err)
+			return
+		}
+		verifyDur := time.Since(verifyStart)
+
+		// per-user limiter (after we know who they are)
+		var claims whoamiResp
+		_ = idTok.Claims(&claims)
+		if claims.Subject == "" {
+			writeJSONError(w, http.StatusUnauthorized, codeInvalidToken, "no subject")
+			return
+		}
+		setSubject(r, claims.Subject)
+		tr := traces.begin(routeOf(r), claims.Subject, claims.Email, start)
+		tr.logf("verified in %s ip=%s iss=%s aud=%s email=%s hd=%s exp=%d", verifyDur, ip, claims.Issuer, claims.Aud, claims.Email, claims.HD, claims.Exp)
+		if subjectDenied(w, claims, tr) {
+			return
+		}
+		if code := emailPolicyError(claims, cfg.RequireEmail, cfg.RequireEmailVerified); code != "" {
+			tr.logf("rejected by email policy: %s", code)
+			writeJSONError(w, http.StatusUnauthorized, code, "")
+			return
+		}
+		ok, retry := whoamiRL.user.allow("user:" + claims.Subject)
+		rateLimitHeaders(w, whoamiRL.user, "user:"+claims.Subject)
+		if !ok {
+			tr.logf("rejected by user limiter, retry after %s", retry)
+			rateLimited.WithLabelValues("user", domains.label(claims.HD)).Inc()
+			w.Header().Set("Retry-After", seconds(retry))
+			writeJSONError(w, http.StatusTooManyRequests, codeRateLimited, "rate limit (user)")
+			return
+		}
+		tr.logf("responding 200")
+
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Content-Type", "application/json")
+		_ = cfg.ResponseCase.encode(w, claims)
+	})
+
+	// issued counts a token handed out and records its lifetime.
+	var ttls ttlStats
+	issued := func(r *http.Request, domain string, ttl int) {
+		tokensIssued.WithLabelValues(routeOf(r), domain).Inc()
+		tokenTTL.WithLabelValues(routeOf(r)).Observe(float64(ttl))
+		ttls.record(ttl)
+	}
+
+	// record audits an issued token and reports it to the webhook.
+	record := func(r *http.Request, rec auditRecord) {
+		audit.write(rec)
+		hook.send(newIssuanceEvent(requestIDOf(r.Context()), rec))
+	}
+
+	// noteNarrowed logs and counts a grant that silently lost requested
+	// scopes, so policy or minter misconfigurations show up.
+	noteNarrowed := func(r *http.Request, sub string, requested []string, granted string) {
+		dropped := droppedScopes(requested, granted)
+		if len(dropped) == 0 {
+			return
+		}
+		scopesNarrowed.WithLabelValues(routeOf(r)).Inc()
+		log.Printf("scopes narrowed: route=%s sub=%s requested=%q granted=%q dropped=%q",
+			routeOf(r), sub, strings.Join(requested, " "), granted, strings.Join(dropped, " "))
+	}
+
+	// gone reports whether the client disconnected, in which case minting
+	// would only spend upstream quota on a token nobody receives.
+	gone := func(r *http.Request, tr *reqTrace) bool {
+		if r.Context().Err() == nil {
+			return false
+		}
+		tr.logf("client_gone: skipping mint")
+		log.Printf("client_gone request_id=%s route=%s ip=%s", requestIDOf(r.Context()), routeOf(r), ips.clientIP(r))
+		clientGone.WithLabelValues(routeOf(r)).Inc()
+		return true
+	}
+
+	// USE_TRAILERS reports the user limiter's remaining budget after the body
+	// as an X-RateLimit-Remaining trailer. HTTP/1.0 has no trailers, so those
+	// clients get it as a regular header computed before the body.
+	startRemaining := func(w http.ResponseWriter, r *http.Request, key string) {
+		if !cfg.UseTrailers {
+			return
+		}
+		if r.ProtoAtLeast(1, 1) {
+			w.Header().Set("Trailer", "X-RateLimit-Remaining")
+			return
+		}
+		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(tokenRL.user.remaining(key)))
+	}
+	finishRemaining := func(w http.ResponseWriter, r *http.Request, key string) {
+		if cfg.UseTrailers && r.ProtoAtLeast(1, 1) {
+			w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(tokenRL.user.remaining(key)))
+		}
+	}
+
+	// scopesPermitted applies SCOPE_POLICY_FILE to a verified caller.
+	scopesPermitted := func(w http.ResponseWriter, caller *mintCaller, scopes []string) bool {
+		sc := scopePol.denied(caller.claims, scopes)
+		if sc == "" {
+			return true
+		}
+		caller.tr.logf("rejected by scope policy: %s", sc)
+		writeJSONError(w, http.StatusForbidden, codeScopeNotPermitted, "scope not permitted: "+sc)
+		return false
+	}
+
+	// token (ID token → short-lived GCP access token)
+	// authorizeMint runs the checks shared by the minting routes: IP limiter,
+	// geo gate, OIDC verification, claim policies, then the per-user limiter
+	// charged cost tokens. On rejection it has already written the response.
+	authorizeMint := func(w http.ResponseWriter, r *http.Request, cost int) (*mintCaller, bool) {
+		start := time.Now()
+
+		// pre-verify IP denylist and limiter
+		ip := ips.clientIP(r)
+		if ipDenied(w, ip) {
+			return nil, false
+		}
+		if ok, retry := tokenRL.allowIP(ip); !ok {
+			rateLimited.WithLabelValues("ip", domainUnknown).Inc()
+			w.Header().Set("Retry-After", seconds(retry))
+			writeJSONError(w, http.StatusTooManyRequests, codeRateLimited, "rate limit (ip)")
+			return nil, false
+		}
+		if !userAgentOK(w, r, ip) {
+			return nil, false
+		}
+
+		// geo gate (optional)
+		if geo != nil && !geo.allow(ip) {
+			writeJSONError(w, http.StatusForbidden, codeGeoBlocked, "")
+			return nil, false
+		}
+
+		raw, ok := bearer(w, r)
+		if !ok {
+			return nil, false
+		}
+		verifyStart := time.Now()
+		idTok, err := verifyForRoute(r, raw)
+		if err != nil {
+			verifyFailed(w, r, err)
+			return nil, false
+		}
+		verifyDur := time.Since(verifyStart)
+
+		var claims whoamiResp
+		_ = idTok.Claims(&claims)
+		setSubject(r, claims.Subject)
+		tr := traces.begin(routeOf(r), claims.Subject, claims.Email, start)
+		tr.logf("verified in %s ip=%s iss=%s aud=%s email=%s hd=%s exp=%d", verifyDur, ip, claims.Issuer, claims.Aud, claims.Email, claims.HD, claims.Exp)
+		if subjectDenied(w, claims, tr) || notAllowlisted(w, claims, tr) {
+			return nil, false
+		}
+		if code := emailPolicyError(claims, cfg.RequireEmail, cfg.RequireEmailVerified); code != "" {
+			tr.logf("rejected by email policy: %s", code)
+			writeJSONError(w, http.StatusUnauthorized, code, "")
+			return nil, false
+		}
+
+		// domain gate (optional)
+		if wrongDomain(w, claims, tr) {
+			return nil, false
+		}
+
+		// refuse to mint for sessions about to end
+		if cfg.MinIDTokenRemaining > 0 && time.Until(idTok.Expiry) < cfg.MinIDTokenRemaining {
+			tr.logf("rejected: id token expires in %s", time.Until(idTok.Expiry).Round(time.Second))
+			writeJSONError(w, http.StatusUnauthorized, codeIDTokenExpiring, "")
+			return nil, false
+		}
+
+		// per-user limiter after identity known
+		if claims.Subject == "" {
+			writeJSONError(w, http.StatusUnauthorized, codeInvalidToken, "no subject")
+			return nil, false
+		}
+		ok, retry := tokenRL.user.allowN("user:"+claims.Subject, cost)
+		rateLimitHeaders(w, tokenRL.user, "user:"+claims.Subject)
+		if !ok {
+			tr.logf("rejected by user limiter (cost %d), retry after %s", cost, retry)
+			rateLimited.WithLabelValues("user", domains.label(claims.HD)).Inc()
+			w.Header().Set("Retry-After", seconds(retry))
+			writeJSONError(w, http.StatusTooManyRequests, codeRateLimited, "rate limit (user)")
+			return nil, false
+		}
+		return &mintCaller{ip: ip, claims: claims, tr: tr, idToken: raw, idExpiry: idTok.Expiry}, true
+	}
+
+	// reserveUse holds one of the caller's ID token uses for a mint; only the
+	// mint endpoints call it, so /ratelimit and friends never spend one.
+	// Defer settle on the result and keep it once the mint has succeeded.
+	reserveUse := func(w http.ResponseWriter, r *http.Request, caller *mintCaller) (*replayUse, bool) {
+		use, ok := replays.reserve(caller.idToken, caller.idExpiry)
+		if !ok {
+			caller.tr.logf("rejected: id token already used %d times", cfg.ReplayMaxUses)
+			replayRejected.WithLabelValues(routeOf(r)).Inc()
+			writeJSONError(w, http.StatusUnauthorized, codeTokenReplayed, "")
+		}
+		return use, ok
+	}
+
+	// client credentials (POST grant_type=client_credentials → token with the client's scopes)
+	mintForClient := func(w http.ResponseWriter, r *http.Request) {
+		ip := ips.clientIP(r)
+		if ipDenied(w, ip) {
+			return
+		}
+		if ok, retry := tokenRL.allowIP(ip); !ok {
+			rateLimited.WithLabelValues("ip", domainUnknown).Inc()
+			w.Header().Set("Retry-After", seconds(retry))
+			writeJSONError(w, http.StatusTooManyRequests, codeRateLimited, "rate limit (ip)")
+			return
+		}
+		if err := r.ParseForm(); bodyTooLarge(w, err) {
+			return
+		}
+		if r.PostFormValue("grant_type") != "client_credentials" {
+			writeJSONError(w, http.StatusBadRequest, codeUnsupportedGrantType, "")
+			return
+		}
+		id, secret, ok := clientCredentialsFrom(r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Basic realm="token-broker"`)
+			writeJSONError(w, http.StatusUnauthorized, codeInvalidClient, "")
+			return
+		}
+		client, ok := clients.authenticate(id, secret)
+		if !ok {
+			log.Printf("client credentials rejected for client_id=%q ip=%s", id, ip)
+			w.Header().Set("WWW-Authenticate", `Basic realm="token-broker"`)
+			writeJSONError(w, http.StatusUnauthorized, codeInvalidClient, "")
+			return
+		}
+		setSubject(r, "client:"+client.ClientID)
+		if ok, retry := clientRL.allow("client:" + client.ClientID); !ok {
+			rateLimited.WithLabelValues("client", domainNone).Inc()
+			w.Header().Set("Retry-After", seconds(retry))
+			writeJSONError(w, http.StatusTooManyRequests, codeRateLimited, "rate limit (client)")
+			return
+		}
+
+		if gone(r, nil) {
+			return
+		}
+		accessTok, err := mintWithRetry(r.Context(), cfg.MintRetries, cfg.MintBackoff, func() (*oauth2.Token, error) {
+			return minter.Mint(r.Context(), whoamiResp{Subject: "client:" + client.ClientID}, client.Scopes)
+		})
+		if err != nil {
+			log.Printf("mint for client %s failed: %v", client.ClientID, err)
+			writeJSONError(w, http.StatusInternalServerError, codeMintFailed, "token mint failed")
+			return
+		}
+		scopes := mintedScopes(accessTok, client.Scopes)
+		noteNarrowed(r, "client:"+client.ClientID, client.Scopes, scopes)
+		ttl := expiresIn(accessTok)
+		fp := tokenFingerprint(accessTok.AccessToken)
+		issued(r, domainNone, ttl)
+		record(r, auditRecord{
+			Time:        time.Now().UTC().Format(time.RFC3339),
+			Event:       "token_issued",
+			Subject:     "client:" + client.ClientID,
+			IP:          ip,
+			Scope:       scopes,
+			ExpiresIn:   ttl,
+			Fingerprint: fp,
+		})
+
+		w.Header().Set("X-Token-Fingerprint", fp)
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Content-Type", "application/json")
+		_ = cfg.ResponseCase.encode(w, tokenResp{
+			AccessToken: accessTok.AccessToken,
+			TokenType:   accessTok.TokenType,
+			ExpiresIn:   ttl,
+			Scope:       scopes,
+		})
+	}
+
+	// token (ID token → short-lived GCP access token)
+	// tokenRequestScopes reads {"scopes": [...], "lifetime": n} from a POST
+	// /token body and checks each scope against ALLOWED_SCOPES, like
+	// /token/batch does.
+	tokenRequestScopes := func(w http.ResponseWriter, r *http.Request) ([]string, string, bool) {
+		var body struct {
+			Scopes   []string `json:"scopes"`
+			Lifetime int      `json:"lifetime"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			if bodyTooLarge(w, err) {
+				return nil, "", false
+			}
+			writeJSONError(w, http.StatusBadRequest, codeInvalidRequest, "invalid JSON body")
+			return nil, "", false
+		}
+		scopes := requestedScopes(body.Scopes)
+		if len(scopes) == 0 {
+			writeJSONError(w, http.StatusBadRequest, codeScopeRequired, "")
+			return nil, "", false
+		}
+		for _, sc := range scopes {
+			if !cfg.AllowedScopes[sc] {
+				writeJSONError(w, http.StatusForbidden, codeScopeNotAllowed, "scope not allowed: "+sc)
+				return nil, "", false
+			}
+		}
+		var lifetime string
+		if body.Lifetime != 0 {
+			lifetime = strconv.Itoa(body.Lifetime)
+		}
+		return scopes, lifetime, true
+	}
+
+	// tokenRequest reads the scopes and lifetime asked for on /token and
+	// /token/introspect: TOKEN_SCOPE and ?lifetime= on GET, the JSON body on
+	// POST. Both call it after authorizeMint, so denied, unauthenticated and
+	// rate-limited callers are turned away before their body is read.
+	tokenRequest := func(w http.ResponseWriter, r *http.Request) ([]string, time.Duration, bool) {
+		requested := []string{cfg.Scope}
+		rawLifetime := r.URL.Query().Get("lifetime")
+		if r.Method == http.MethodPost {
+			scopes, l, ok := tokenRequestScopes(w, r)
+			if !ok {
+				return nil, 0, false
+			}
+			requested = scopes
+			if l != "" {
+				rawLifetime = l
+			}
+		}
+		lifetime, err := parseLifetime(rawLifetime, cfg.MaxTokenLifetime)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+			return nil, 0, false
+		}
+		return requested, lifetime, true
+	}
+
+	// account picks the service account for ?project= or the caller's
+	// domain (SERVICE_ACCOUNTS_FILE); everyone else gets the primary one.
+	saEmail := serviceAccountEmail(cfg)
+	account := func(w http.ResponseWriter, r *http.Request, caller *mintCaller) (Minter, *serviceAccount, bool) {
+		project := r.URL.Query().Get("project")
+		acct, err := accounts.pick(caller.claims, project)
+		if err != nil {
+			caller.tr.logf("rejected: project %q not allowed", project)
+			writeJSONError(w, http.StatusForbidden, codeProjectNotAllowed, "project not allowed: "+project)
+			return nil, nil, false
+		}
+		if acct == nil {
+			return minter, nil, true
+		}
+		return acct.minter, acct, true
+	}
+
+	routes.handleFunc("/token", []string{http.MethodGet, http.MethodPost}, func(w http.ResponseWriter, r *http.Request) {
+		cors.lookup("/token").apply(w, r)
+		// POST with a JSON body narrows the scopes; other POSTs are client credentials
+		switch {
+		case r.Method == http.MethodPost && isJSON(r):
+		case r.Method == http.MethodPost && clients != nil:
+			mintForClient(w, r)
+			return
+		case r.Method == http.MethodPost:
+			writeJSONError(w, http.StatusUnsupportedMediaType, codeInvalidRequest, "POST /token needs a JSON body")
+			return
+		case cfg.DeprecateGetToken:
+			// GET still works; tell clients to move to POST before the sunset
+			w.Header().Set("Deprecation", "true")
+			if !cfg.GetTokenSunset.IsZero() {
+				w.Header().Set("Sunset", cfg.GetTokenSunset.Format(http.TimeFormat))
+			}
+		}
+		caller, ok := authorizeMint(w, r, 1)
+		if !ok {
+			return
+		}
+		requested, lifetime, ok := tokenRequest(w, r)
+		if !ok {
+			return
+		}
+		tr := caller.tr
+		if !scopesPermitted(w, caller, requested) {
+			return
+		}
+		mint, acct, ok := account(w, r, caller)
+		if !ok {
+			return
+		}
+		resource := r.URL.Query().Get("resource")
+		if resource != "" && !downscopes.allows(resource) {
+			writeJSONError(w, http.StatusForbidden, codeResourceNotAllowed, "resource not allowed: "+resource)
+			return
+		}
+		if gone(r, tr) {
+			return
+		}
+		use, ok := reserveUse(w, r, caller)
+		if !ok {
+			return
+		}
+		defer use.settle()
+
+		// mint short-lived GCP token
+		mintStart := time.Now()
+		accessTok, err := mintWithRetry(r.Context(), cfg.MintRetries, cfg.MintBackoff, func() (*oauth2.Token, error) {
+			return mint.Mint(withLifetime(r.Context(), lifetime), caller.claims, requested)
+		})
+		if err != nil {
+			tr.logf("mint failed after %s: %v", time.Since(mintStart), err)
+			writeJSONError(w, http.StatusInternalServerError, codeMintFailed, "token mint failed")
+			return
+		}
+		tr.logf("minted in %s, expires %s", time.Since(mintStart), accessTok.Expiry.UTC().Format(time.RFC3339))
+		scopes := mintedScopes(accessTok, requested)
+		noteNarrowed(r, caller.claims.Subject, requested, scopes)
+		if resource != "" {
+			root := accessTok
+			if accessTok, err = downscopes.downscope(out.ctx(r.Context()), root, resource); err != nil {
+				tr.logf("downscope to %s failed: %v", resource, err)
+				writeJSONError(w, http.StatusInternalServerError, codeMintFailed, "token mint failed")
+				return
+			}
+			if accessTok.Expiry.IsZero() {
+				accessTok.Expiry = root.Expiry
+			}
+			tr.logf("downscoped to %s", resource)
+		}
+		use.keep()
+		ttl := clampTTL(expiresIn(accessTok), lifetime)
+		fp := tokenFingerprint(accessTok.AccessToken)
+		issued(r, domains.label(caller.claims.HD), ttl)
+		rec := auditRecord{
+			Time:        time.Now().UTC().Format(time.RFC3339),
+			Event:       "token_issued",
+			Subject:     caller.claims.Subject,
+			Email:       caller.claims.Email,
+			IP:          caller.ip,
+			Scope:       scopes,
+			Resource:    resource,
+			ExpiresIn:   ttl,
+			Fingerprint: fp,
+		}
+		if acct != nil {
+			rec.ServiceAccount = acct.email
+		}
+		record(r, rec)
+
+		// ?verify=1 cross-checks the reported scopes against Google's tokeninfo
+		var verified *bool
+		if r.URL.Query().Get("verify") == "1" {
+			info, err := tokeninfoScopes(out.ctx(r.Context()), accessTok.AccessToken)
+			if err != nil {
+				tr.logf("tokeninfo failed: %v", err)
+			} else {
+				same := sameScopes(scopes, info)
+				if !same {
+					log.Printf("scope mismatch for fingerprint %s: minted %q, tokeninfo %q", fp, scopes, info)
+				}
+				verified = &same
+			}
+		}
+
+		userKey := "user:" + caller.claims.Subject
+		startRemaining(w, r, userKey)
+		w.Header().Set("X-Token-Fingerprint", fp)
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Content-Type", "application/json")
+		_ = cfg.ResponseCase.encode(w, tokenResp{
+			AccessToken:   accessTok.AccessToken,
+			TokenType:     accessTok.TokenType,
+			ExpiresIn:     ttl,
+			Scope:         scopes,
+			ScopeVerified: verified,
+		})
+		finishRemaining(w, r, userKey)
+	})
+
+	// token introspect: the /token flow, including its limits and gates, up
+	// to the mint; reports what would be issued without issuing it
+	defaultLifetime := time.Hour // Google's fixed lifetime for SA key tokens
+	if cfg.ImpersonateSA != "" {
+		defaultLifetime = cfg.ImpersonateLifetime
+	}
+	routes.handleFunc("/token/introspect", []string{http.MethodGet, http.MethodPost}, func(w http.ResponseWriter, r *http.Request) {
+		cors.lookup("/token/introspect").apply(w, r)
+		if r.Method == http.MethodPost && !isJSON(r) {
+			writeJSONError(w, http.StatusUnsupportedMediaType, codeInvalidRequest, "POST /token/introspect needs a JSON body")
+			return
+		}
+		caller, ok := authorizeMint(w, r, 1)
+		if !ok {
 			return
 		}
+		requested, lifetime, ok := tokenRequest(w, r)
+		if !ok {
+			return
+		}
+		if !scopesPermitted(w, caller, requested) {
+			return
+		}
+		_, acct, ok := account(w, r, caller)
+		if !ok {
+			return
+		}
+		sa := saEmail
+		if acct != nil {
+			sa = acct.email
+		}
+		resource := r.URL.Query().Get("resource")
+		if resource != "" && !downscopes.allows(resource) {
+			writeJSONError(w, http.StatusForbidden, codeResourceNotAllowed, "resource not allowed: "+resource)
+			return
+		}
+		if lifetime == 0 {
+			lifetime = defaultLifetime
+		}
+		caller.tr.logf("introspected %q", requested)
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Content-Type", "application/json")
+		_ = cfg.ResponseCase.encode(w, tokenIntrospectResp{
+			Scope:          strings.Join(requested, " "),
+			ExpiresIn:      int(lifetime.Seconds()),
+			ServiceAccount: sa,
+			Resource:       resource,
+			CacheEnabled:   cfg.TokenCache,
+		})
+	})
+
+	// token batch (one narrowly-scoped token per requested scope)
+	routes.handleFunc("/token/batch", get, func(w http.ResponseWriter, r *http.Request) {
+		cors.lookup("/token/batch").apply(w, r)
+		scopes := requestedScopes(r.URL.Query()["scope"])
+		if len(scopes) == 0 {
+			writeJSONError(w, http.StatusBadRequest, codeScopeRequired, "")
+			return
+		}
+		for _, sc := range scopes {
+			if !cfg.AllowedScopes[sc] {
+				writeJSONError(w, http.StatusForbidden, codeScopeNotAllowed, "scope not allowed: "+sc)
+				return
+			}
+		}
+		// each scope is a separate mint, so charge the user limiter per scope
+		caller, ok := authorizeMint(w, r, len(scopes))
+		if !ok || !scopesPermitted(w, caller, scopes) {
+			return
+		}
+		tr := caller.tr
+		mint, acct, ok := account(w, r, caller)
+		if !ok {
+			return
+		}
+		use, ok := reserveUse(w, r, caller)
+		if !ok {
+			return
+		}
+		// one use covers the batch, spent only if every scope mints
+		defer use.settle()
+
+		out := make([]scopedTokenResp, 0, len(scopes))
+		for _, sc := range scopes {
+			if gone(r, tr) {
+				return
+			}
+			mintStart := time.Now()
+			accessTok, err := mintWithRetry(r.Context(), cfg.MintRetries, cfg.MintBackoff, func() (*oauth2.Token, error) {
+				return mint.Mint(r.Context(), caller.claims, []string{sc})
+			})
+			if err != nil {
+				tr.logf("mint %s failed after %s: %v", sc, time.Since(mintStart), err)
+				writeJSONError(w, http.StatusInternalServerError, codeMintFailed, "token mint failed")
+				return
+			}
+			tr.logf("minted %s in %s, expires %s", sc, time.Since(mintStart), accessTok.Expiry.UTC().Format(time.RFC3339))
+			scoped := mintedScopes(accessTok, []string{sc})
+			noteNarrowed(r, caller.claims.Subject, []string{sc}, scoped)
+			ttl := expiresIn(accessTok)
+			fp := tokenFingerprint(accessTok.AccessToken)
+			issued(r, domains.label(caller.claims.HD), ttl)
+			rec := auditRecord{
+				Time:        time.Now().UTC().Format(time.RFC3339),
+				Event:       "token_issued",
+				Subject:     caller.claims.Subject,
+				Email:       caller.claims.Email,
+				IP:          caller.ip,
+				Scope:       scoped,
+				ExpiresIn:   ttl,
+				Fingerprint: fp,
+			}
+			if acct != nil {
+				rec.ServiceAccount = acct.email
+			}
+			record(r, rec)
+			out = append(out, scopedTokenResp{
+				Scope:       sc,
+				AccessToken: accessTok.AccessToken,
+				TokenType:   accessTok.TokenType,
+				ExpiresIn:   ttl,
+				Fingerprint: fp,
+			})
+		}
+		use.keep()
+
+		userKey := "user:" + caller.claims.Subject
+		startRemaining(w, r, userKey)
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Content-Type", "application/json")
+		_ = cfg.ResponseCase.encode(w, out)
+		finishRemaining(w, r, userKey)
+	})
+
+	// ratelimit (caller's effective per-user policy; free, but has its own limiter)
+	policyRL := newLimiterRegistry(cfg.RatelimitPerMin, cfg.RatelimitBurst, cfg.LimiterColdTokens, cfg.CleanupMins, nil)
+	policyRL.share(shared, "ratelimit")
+	go policyRL.cleanupLoop(ctx)
+	routes.handleFunc("/ratelimit", get, func(w http.ResponseWriter, r *http.Request) {
+		cors.lookup("/ratelimit").apply(w, r)
+		caller, ok := authorizeMint(w, r, 0)
+		if !ok {
+			return
+		}
+		userKey := "user:" + caller.claims.Subject
+		if ok, retry := policyRL.allow(userKey); !ok {
+			rateLimited.WithLabelValues("ratelimit", domains.label(caller.claims.HD)).Inc()
+			w.Header().Set("Retry-After", seconds(retry))
+			writeJSONError(w, http.StatusTooManyRequests, codeRateLimited, "rate limit (ratelimit)")
+			return
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(tokenRL.user.policy(userKey))
+	})
+
+	// token stream (opt-in SSE; pushes a fresh token before each expiry)
+	if cfg.TokenStream {
+		endpoints = append(endpoints, "/token/stream")
+		cors["/token/stream"] = routeCORS(cfg, "TOKEN")
+		slots := newStreamSlots(cfg.StreamMaxPerUser)
+		refreshBefore := cfg.StreamRefreshBefore
+
+		routes.handleFunc("/token/stream", get, func(w http.ResponseWriter, r *http.Request) {
+			cors.lookup("/token/stream").apply(w, r)
+			flusher, ok := w.(http.Flusher)
+			if !ok {
+				writeJSONError(w, http.StatusInternalServerError, codeInternal, "streaming unsupported")
+				return
+			}
+			caller, ok := authorizeMint(w, r, 1)
+			if !ok {
+				return
+			}
+			if !scopesPermitted(w, caller, []string{cfg.Scope}) {
+				return
+			}
+			mint, acct, ok := account(w, r, caller)
+			if !ok {
+				return
+			}
+			tr := caller.tr
+			sub := caller.claims.Subject
+			if !slots.acquire(sub) {
+				tr.logf("rejected: too many concurrent streams")
+				writeJSONError(w, http.StatusTooManyRequests, codeTooManyStreams, "")
+				return
+			}
+			defer slots.release(sub)
+			// the whole stream is one use, spent by its first successful mint
+			use, ok := reserveUse(w, r, caller)
+			if !ok {
+				return
+			}
+			defer use.settle()
+			// WRITE_TIMEOUT bounds one response; a stream is meant to outlive it
+			_ = http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+			// the stream ends when the ID token would expire
+			sessionEnd := time.NewTimer(time.Until(time.Unix(caller.claims.Exp, 0)))
+			defer sessionEnd.Stop()
+			keepalive := time.NewTicker(30 * time.Second)
+			defer keepalive.Stop()
+
+			w.Header().Set("Cache-Control", "no-store")
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Header().Set("X-Accel-Buffering", "no")
+			w.WriteHeader(http.StatusOK)
+			flusher.Flush()
+
+			for {
+				mintStart := time.Now()
+				accessTok, err := mintWithRetry(r.Context(), cfg.MintRetries, cfg.MintBackoff, func() (*oauth2.Token, error) {
+					return mint.Mint(r.Context(), caller.claims, []string{cfg.Scope})
+				})
+				if err != nil {
+					tr.logf("stream mint failed after %s: %v", time.Since(mintStart), err)
+					_ = writeEvent(w, flusher, cfg.ResponseCase, "error", map[string]string{"error": "token mint failed"})
+					return
+				}
+				tr.logf("stream minted in %s, expires %s", time.Since(mintStart), accessTok.Expiry.UTC().Format(time.RFC3339))
+				use.keep()
+				ttl := expiresIn(accessTok)
+				scopes := mintedScopes(accessTok, []string{cfg.Scope})
+				noteNarrowed(r, caller.claims.Subject, []string{cfg.Scope}, scopes)
+				issued(r, domains.label(caller.claims.HD), ttl)
+				rec := auditRecord{
+					Time:        time.Now().UTC().Format(time.RFC3339),
+					Event:       "token_issued",
+					Subject:     sub,
+					Email:       caller.claims.Email,
+					IP:          caller.ip,
+					Scope:       scopes,
+					ExpiresIn:   ttl,
+					Fingerprint: tokenFingerprint(accessTok.AccessToken),
+				}
+				if acct != nil {
+					rec.ServiceAccount = acct.email
+				}
+				record(r, rec)
+				if err := writeEvent(w, flusher, cfg.ResponseCase, "token", tokenResp{
+					AccessToken: accessTok.AccessToken,
+					TokenType:   accessTok.TokenType,
+					ExpiresIn:   ttl,
+					Scope:       scopes,
+				}); err != nil {
+					return
+				}
+
+				// never re-mint more than twice a minute, even for short-lived tokens
+				next := max(time.Duration(ttl)*time.Second-refreshBefore, 30*time.Second)
+				refresh := time.NewTimer(next)
+			wait:
+				for {
+					select {
+					case <-r.Context().Done():
+						refresh.Stop()
+						return
+					case <-drainStart:
+						// let shutdown finish instead of waiting out the stream
+						refresh.Stop()
+						_ = writeEvent(w, flusher, cfg.ResponseCase, "end", map[string]string{"reason": "shutting_down"})
+						return
+					case <-sessionEnd.C:
+						refresh.Stop()
+						tr.logf("stream closed: id token expired")
+						_ = writeEvent(w, flusher, cfg.ResponseCase, "end", map[string]string{"reason": "id_token_expired"})
+						return
+					case <-keepalive.C:
+						if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+							refresh.Stop()
+							return
+						}
+						flusher.Flush()
+					case <-refresh.C:
+						break wait
+					}
+				}
+			}
+		})
+	}
+
+	// identity tokens (opt-in): a Google-signed ID token for an allow-listed
+	// audience, for services like Cloud Run and IAP that don't take access tokens
+	if len(cfg.IDTokenAudiences) > 0 {
+		endpoints = append(endpoints, "/idtoken")
+		cors["/idtoken"] = routeCORS(cfg, "IDTOKEN")
+		routes.handleFunc("/idtoken", get, func(w http.ResponseWriter, r *http.Request) {
+			cors.lookup("/idtoken").apply(w, r)
+			audience := strings.TrimSpace(r.URL.Query().Get("audience"))
+			if audience == "" {
+				writeJSONError(w, http.StatusBadRequest, codeAudienceRequired, "")
+				return
+			}
+			if !cfg.IDTokenAudiences[audience] {
+				writeJSONError(w, http.StatusForbidden, codeAudienceNotAllowed, "audience not allowed: "+audience)
+				return
+			}
+			caller, ok := authorizeMint(w, r, 1)
+			if !ok {
+				return
+			}
+			tr := caller.tr
+			if gone(r, tr) {
+				return
+			}
+			use, ok := reserveUse(w, r, caller)
+			if !ok {
+				return
+			}
+			defer use.settle()
+			mintStart := time.Now()
+			src, err := sources.idToken(audience)
+			var idTok *oauth2.Token
+			if err == nil {
+				idTok, err = mintWithRetry(r.Context(), cfg.MintRetries, cfg.MintBackoff, src.Token)
+			}
+			if err != nil {
+				tr.logf("id token for %s failed after %s: %v", audience, time.Since(mintStart), err)
+				writeJSONError(w, http.StatusInternalServerError, codeMintFailed, "id token mint failed")
+				return
+			}
+			tr.logf("minted id token for %s in %s, expires %s", audience, time.Since(mintStart), idTok.Expiry.UTC().Format(time.RFC3339))
+			use.keep()
+			ttl := expiresIn(idTok)
+			issued(r, domains.label(caller.claims.HD), ttl)
+			record(r, auditRecord{
+				Time:        time.Now().UTC().Format(time.RFC3339),
+				Event:       "id_token_issued",
+				Subject:     caller.claims.Subject,
+				Email:       caller.claims.Email,
+				IP:          caller.ip,
+				Audience:    audience,
+				ExpiresIn:   ttl,
+				Fingerprint: tokenFingerprint(idTok.AccessToken),
+			})
+			w.Header().Set("Cache-Control", "no-store")
+			w.Header().Set("Content-Type", "application/json")
+			_ = cfg.ResponseCase.encode(w, tokenResp{AccessToken: idTok.AccessToken, TokenType: "Bearer", ExpiresIn: ttl})
+		})
+	}
+
+	// broker tickets (opt-in): an HS256 JWT saying the broker verified this
+	// identity, for internal services that shouldn't depend on Google
+	if len(cfg.TicketSigningKey) > 0 {
+		endpoints = append(endpoints, "/ticket")
+		cors["/ticket"] = routeCORS(cfg, "TICKET")
+		routes.handleFunc("/ticket", get, func(w http.ResponseWriter, r *http.Request) {
+			cors.lookup("/ticket").apply(w, r)
+			caller, ok := authorizeMint(w, r, 1)
+			if !ok {
+				return
+			}
+			use, ok := reserveUse(w, r, caller)
+			if !ok {
+				return
+			}
+			defer use.settle()
+			raw, tc, err := newTicket(cfg.TicketSigningKey, cfg.TicketIssuer, caller.claims, cfg.TicketTTL, time.Now())
+			if err != nil {
+				caller.tr.logf("ticket signing failed: %v", err)
+				writeJSONError(w, http.StatusInternalServerError, codeInternal, "")
+				return
+			}
+			use.keep()
+			ttl := int(tc.Expiry - tc.IssuedAt)
+			caller.tr.logf("issued ticket, expires %s", time.Unix(tc.Expiry, 0).UTC().Format(time.RFC3339))
+			issued(r, domains.label(caller.claims.HD), ttl)
+			record(r, auditRecord{
+				Time:        time.Now().UTC().Format(time.RFC3339),
+				Event:       "ticket_issued",
+				Subject:     caller.claims.Subject,
+				Email:       caller.claims.Email,
+				IP:          caller.ip,
+				ExpiresIn:   ttl,
+				Fingerprint: tokenFingerprint(raw),
+			})
+			w.Header().Set("Cache-Control", "no-store")
+			w.Header().Set("Content-Type", "application/json")
+			_ = cfg.ResponseCase.encode(w, ticketResp{Ticket: raw, TokenType: "Bearer", ExpiresIn: ttl})
+		})
+	}
+
+	// userinfo proxy (opt-in; its own limiter since each miss is an upstream call)
+	if cfg.Userinfo {
+		endpoints = append(endpoints, "/userinfo")
+		cors["/userinfo"] = routeCORS(cfg, "USERINFO")
+		userinfo := newUserinfoProxy(cfg.SAJSON, out, cfg.UserinfoTTL)
+		userinfoRL := newLimiterRegistry(cfg.UserinfoPerMin, cfg.UserinfoBurst, cfg.LimiterColdTokens, cfg.CleanupMins, overrides)
+		userinfoRL.share(shared, "userinfo")
+		go userinfoRL.cleanupLoop(ctx)
+
+		routes.handleFunc("/userinfo", get, func(w http.ResponseWriter, r *http.Request) {
+			cors.lookup("/userinfo").apply(w, r)
+			caller, ok := authorizeMint(w, r, 1)
+			if !ok {
+				return
+			}
+			tr := caller.tr
+			if ok, retry := userinfoRL.allow("user:" + caller.claims.Subject); !ok {
+				tr.logf("rejected by userinfo limiter, retry after %s", retry)
+				rateLimited.WithLabelValues("userinfo", domains.label(caller.claims.HD)).Inc()
+				w.Header().Set("Retry-After", seconds(retry))
+				writeJSONError(w, http.StatusTooManyRequests, codeRateLimited, "rate limit (userinfo)")
+				return
+			}
+			if caller.claims.Email == "" {
+				writeJSONError(w, http.StatusUnauthorized, codeEmailRequired, "")
+				return
+			}
+			fetchStart := time.Now()
+			body, err := userinfo.fetch(r.Context(), caller.claims.Subject, caller.claims.Email)
+			if err != nil {
+				tr.logf("userinfo failed after %s: %v", time.Since(fetchStart), err)
+				writeJSONError(w, http.StatusBadGateway, codeUserinfoFailed, "")
+				return
+			}
+			tr.logf("userinfo fetched in %s", time.Since(fetchStart))
+			w.Header().Set("Cache-Control", "no-store")
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write(body)
+		})
+	}
+
+	// introspect (opt-in, RFC 7662 style; server-to-server, so no CORS).
+	// INTROSPECT_ANY_AUDIENCE accepts tokens issued to other clients here only.
+	if cfg.Introspect {
+		endpoints = append(endpoints, "/introspect")
+		verifyIntrospect := verifier.Verify
+		if cfg.IntrospectAnyAudience {
+			log.Printf("WARNING: /introspect accepts ID tokens for any audience")
+			verifyIntrospect = verifier.VerifyAnyAudience
+		}
+		routes.handleFunc("/introspect", post, func(w http.ResponseWriter, r *http.Request) {
+			ip := ips.clientIP(r)
+			if ipDenied(w, ip) {
+				return
+			}
+			if ok, retry := tokenRL.allowIP(ip); !ok {
+				rateLimited.WithLabelValues("ip", domainUnknown).Inc()
+				w.Header().Set("Retry-After", seconds(retry))
+				writeJSONError(w, http.StatusTooManyRequests, codeRateLimited, "rate limit (ip)")
+				return
+			}
+			if err := r.ParseForm(); bodyTooLarge(w, err) {
+				return
+			}
+			raw := r.PostFormValue("token")
+			if raw == "" {
+				writeJSONError(w, http.StatusBadRequest, codeInvalidRequest, "token is required")
+				return
+			}
+			w.Header().Set("Cache-Control", "no-store")
+			w.Header().Set("Content-Type", "application/json")
+			idTok, err := verifyIntrospect(r.Context(), raw)
+			if err != nil {
+				_ = cfg.ResponseCase.encode(w, introspectResp{Active: false})
+				return
+			}
+			var claims whoamiResp
+			_ = idTok.Claims(&claims)
+			_ = cfg.ResponseCase.encode(w, introspectResp{Active: true, whoamiResp: &claims})
+		})
+	}
+
+	// Metrics (opt-in; never CORS-enabled). METRICS_ADDR moves them to their
+	// own listener so they needn't be reachable on the public port.
+	if cfg.MetricsEnabled && cfg.MetricsAddr == "" {
+		routes.handle("/metrics", get, promhttp.Handler())
+	}
+	if cfg.MetricsEnabled && cfg.MetricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.Handler())
+		go func() {
+			log.Printf("metrics listening on %s", cfg.MetricsAddr)
+			log.Fatalf("metrics listener: %v", http.ListenAndServe(cfg.MetricsAddr, mux))
+		}()
+	}
+
+	// Admin (enabled only when ADMIN_TOKEN is set)
+	if cfg.AdminToken != "" {
+		// GET /admin/status summarizes issued token lifetimes
+		routes.handleFunc("/admin/status", get, func(w http.ResponseWriter, r *http.Request) {
+			if !adminAuthorized(r, cfg.AdminToken) {
+				writeJSONError(w, http.StatusUnauthorized, codeUnauthorized, "unauthorized")
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(map[string]any{"token_ttl": ttls.summary()})
+		})
+
+		// POST /admin/trace?sub=...|email=...&ttl=10m enables per-user tracing; DELETE stops it
+		routes.handleFunc("/admin/trace", []string{http.MethodPost, http.MethodDelete}, func(w http.ResponseWriter, r *http.Request) {
+			if !adminAuthorized(r, cfg.AdminToken) {
+				writeJSONError(w, http.StatusUnauthorized, codeUnauthorized, "unauthorized")
+				return
+			}
+			q := r.URL.Query()
+			var key string
+			switch {
+			case q.Get("sub") != "" && q.Get("email") == "":
+				key = "sub:" + q.Get("sub")
+			case q.Get("email") != "" && q.Get("sub") == "":
+				key = traces.emailKey(q.Get("email"))
+			default:
+				writeJSONError(w, http.StatusBadRequest, codeInvalidRequest, "exactly one of sub or email is required")
+				return
+			}
+
+			switch r.Method {
+			case http.MethodPost:
+				ttl := defaultTraceTTL
+				if v := q.Get("ttl"); v != "" {
+					d, err := time.ParseDuration(v)
+					if err != nil || d <= 0 || d > maxTraceTTL {
+						writeJSONError(w, http.StatusBadRequest, codeInvalidRequest, "ttl must be a positive duration up to "+maxTraceTTL.String())
+						return
+					}
+					ttl = d
+				}
+				exp := traces.enable(key, ttl)
+				w.Header().Set("Content-Type", "application/json")
+				_ = json.NewEncoder(w).Encode(map[string]any{"trace": key, "expires_at": exp.UTC().Format(time.RFC3339)})
+			case http.MethodDelete:
+				traces.disable(key)
+				w.WriteHeader(http.StatusNoContent)
+			}
+		})
+	}
+
+	// Wrap with per-route CORS. Preflight gets 204 only for existing
+	// CORS-enabled routes and allowed methods; unknown paths get 404 (with
+	// the global CORS headers so browsers can see it).
+	notFoundCORS := defaultCORS(cfg.CORSOrigin, cfg.CORSCredentials)
+	for path, p := range cors {
+		p.withMethods(routes.allow(path))
+	}
+	// hostAllowed enforces ALLOWED_HOSTS on the Host header (port ignored)
+	hostAllowed := func(r *http.Request) bool {
+		if len(cfg.AllowedHosts) == 0 {
+			return true
+		}
+		if cfg.AllowedHostsExemptHealthz && (r.URL.Path == "/healthz" || r.URL.Path == "/livez" || r.URL.Path == "/readyz") {
+			return true
+		}
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		return cfg.AllowedHosts[strings.ToLower(strings.TrimSuffix(host, "."))]
+	}
+
+	compress, err := newCompression(cfg.CompressAlgos, cfg.CompressMinBytes)
+	if err != nil {
+		return nil, fmt.Errorf("COMPRESS_ALGOS: %w", err)
+	}
+	mux := recoverPanics(routes.mux)
+	var inFlight atomic.Int64
+	// MAX_INFLIGHT slots; probes and streams don't take one
+	var slots chan struct{}
+	if cfg.MaxInFlight > 0 {
+		slots = make(chan struct{}, cfg.MaxInFlight)
+	}
+	unbounded := func(route string) bool {
+		switch route {
+		case "/livez", "/healthz", "/readyz", "/token/stream":
+			return true
+		}
+		return false
+	}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inFlight.Add(1)
+		defer inFlight.Add(-1)
+		start := time.Now()
+		route := routes.label(r.URL.Path)
+		// RESPONSE_MIN_MS: hold every response (success or failure) until the
+		// floor. Bodies are still buffered when the handler returns, so waiting
+		// here delays the whole response. Streams are exempt.
+		if cfg.ResponseMin > 0 && route != "/token/stream" {
+			defer padUntil(r.Context(), start.Add(cfg.ResponseMin))
+		}
+		r = withRoute(r, route)
+		rid := requestIDFor(r)
+		r = withRequestID(r, rid)
+		w.Header().Set(requestIDHeader, rid)
+		requestsTotal.WithLabelValues(route, methodLabel(r.Method)).Inc()
+		rec := &statusRecorder{ResponseWriter: w}
+		w = rec
+		if tracing {
+			var endSpan func(status int)
+			r, endSpan = startRequestSpan(r, route)
+			defer func() { endSpan(rec.status()) }()
+		}
+		r, info := withAccessInfo(r)
+		defer func() {
+			responsesTotal.WithLabelValues(route, strconv.Itoa(rec.status())).Inc()
+			logAccess(r, ips.clientIP(r), info, rec.status(), start)
+		}()
+		if !hostAllowed(r) {
+			writeJSONError(w, http.StatusBadRequest, codeBadHost, "")
+			return
+		}
+		p := cors.lookup(r.URL.Path)
+		p.apply(w, r)
+		if r.Method == http.MethodOptions {
+			switch {
+			case route == routeUnknown:
+				notFoundCORS.apply(w, r)
+				writeJSONError(w, http.StatusNotFound, codeNotFound, "not found")
+				return
+			case p != nil && !p.allows(r.Header.Get("Access-Control-Request-Method")):
+				w.Header().Set("Allow", routes.allow(route))
+				writeJSONError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+				return
+			default:
+				w.Header().Set("Allow", routes.allow(route))
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+		if !routes.permits(route, r.Method) {
+			w.Header().Set("Allow", routes.allow(route))
+			writeJSONError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+			return
+		}
+		// MAX_BODY_BYTES: a declared oversize body is refused before it is
+		// read; a chunked one fails its handler's read at the limit
+		if r.ContentLength > int64(cfg.MaxBodyBytes) {
+			writeJSONError(w, http.StatusRequestEntityTooLarge, codeBodyTooLarge, fmt.Sprintf("request body exceeds %d bytes", cfg.MaxBodyBytes))
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, int64(cfg.MaxBodyBytes))
+		if slots != nil && !unbounded(route) {
+			select {
+			case slots <- struct{}{}:
+				defer func() { <-slots }()
+			default:
+				overloaded.WithLabelValues(route).Inc()
+				w.Header().Set("Retry-After", "1")
+				writeJSONError(w, http.StatusServiceUnavailable, codeOverloaded, "")
+				return
+			}
+		}
+		// compress large bodies when COMPRESS_ALGOS is set; streams are exempt
+		if compress != nil && route != "/token/stream" {
+			cw, finish := compress.wrap(w, r)
+			defer finish()
+			w = cw
+		}
 		mux.ServeHTTP(w, r)
 	})
 
-	addr := ":" + getEnv("PORT", "10000")
-	log.Printf("listening on %s", addr)
-	log.Fatal(http.ListenAndServe(addr, handler))
+	if cfg.ReadyAfterFirstMint {
+		go warmupMint(ctx, minter, cfg.Scope)
+	}
+	return &server{
+		Handler:    handler,
+		cancel:     cancel,
+		inFlight:   &inFlight,
+		draining:   &draining,
+		drainStart: drainStart,
+		audit:      audit,
+		hook:       hook,
+		redis:      shared,
+		cfg:        cfg,
+	}, nil
+}
+
+// ------- main -------
+func main() {
+	cfg, err := loadConfig()
+	if err != nil {
+		log.Fatalf("invalid configuration:\n%v", err)
+	}
+	slog.SetDefault(newLogger(cfg.LogLevel))
+	errorCompat = cfg.ErrorCompat
+	warnImplausibleClientIDs(cfg.Providers)
+	if cfg.OTelEndpoint != "" {
+		shutdown, err := setupTracing(context.Background())
+		if err != nil {
+			log.Fatalf("tracing: %v", err)
+		}
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := shutdown(ctx); err != nil {
+				log.Printf("tracing: flush: %v", err)
+			}
+		}()
+	}
+
+	// Outbound proxy for Google/IdP calls (optional; independent of HTTP_PROXY)
+	out, err := newEgress(cfg.OutboundProxyURL, cfg.OutboundProxyUser, cfg.OutboundProxyPassword)
+	if err != nil {
+		log.Fatalf("OUTBOUND_PROXY_URL: %v", err)
+	}
+
+	// Per-scope sources behind the Minter and /idtoken. Impersonation (ADC →
+	// IMPERSONATE_SA_EMAIL) replaces the SA key when set. Either way, fail
+	// fast on bad credentials before serving.
+	var sources *scopeSources
+	if cfg.ImpersonateSA != "" {
+		base, err := defaultCredentials(out.ctx(context.Background()))
+		if err != nil {
+			log.Fatalf("application default credentials: %v", err)
+		}
+		sources = newImpersonatedSources(out.ctx(context.Background()), base, cfg.ImpersonateSA, cfg.ImpersonateLifetime)
+	} else {
+		sources = newScopeSources(out.ctx(context.Background()), cfg.SAJSON)
+	}
+
+	// OIDC verifier (routed by issuer). Discovery and key refresh get their
+	// own context so shutdown doesn't cancel them under in-flight requests.
+	keysCtx, stopKeys := context.WithCancel(out.ctx(context.Background()))
+	defer stopKeys()
+	verifier, err := newIssuerVerifier(keysCtx, cfg.Providers, cfg.OIDCSkew)
+	if err != nil {
+		log.Fatalf("oidc: %v", err)
+	}
+	verifier.cache = newVerifyCache(cfg.VerifyCacheSize)
+
+	var minter Minter = &googleMinter{sources: sources, out: out}
+	if cfg.TokenCache {
+		minter = newCachingMinter(minter, cfg.RefreshSkew)
+	}
+	if cfg.StartupSelftest {
+		if err := selfTestMint(context.Background(), minter, cfg.Scope); err != nil {
+			log.Fatalf("startup self-test: minting %s failed: %v", cfg.Scope, err)
+		}
+		log.Printf("startup self-test: minted %s", cfg.Scope)
+	}
+
+	s, err := newServer(cfg, verifier, minter, sources, out)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ln, err := listen(cfg.ListenNetwork, cfg.ListenAddr, cfg.ListenSocketMode)
+	if err != nil {
+		log.Fatalf("listen: %v", err)
+	}
+	log.Printf("listening on %s:%s", cfg.ListenNetwork, cfg.ListenAddr)
+	if cfg.ListenNetwork == "unix" {
+		log.Printf("unix socket: per-IP limits key on X-Forwarded-For and are skipped for requests without it")
+	}
+	if cfg.KeysetRefreshInterval > 0 {
+		go verifier.refreshLoop(keysCtx, cfg.KeysetRefreshInterval)
+	}
+	if cfg.PrefetchJWKS {
+		go verifier.prefetch(out.ctx(keysCtx), cfg.PrefetchJWKSAttempts)
+	}
+	srv := newHTTPServer(cfg, s)
+	serveErr := make(chan error, 1)
+	go func() {
+		if cfg.TLSCertFile != "" {
+			srv.TLSConfig = newTLSConfig(cfg.TLSMinVersion)
+			serveErr <- srv.ServeTLS(ln, cfg.TLSCertFile, cfg.TLSKeyFile)
+			return
+		}
+		serveErr <- srv.Serve(ln)
+	}()
+
+	// On SIGINT/SIGTERM stop accepting, let in-flight requests (mints in
+	// particular) finish within SHUTDOWN_TIMEOUT, then stop background work
+	// and flush the audit log.
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err := <-serveErr:
+		log.Fatal(err)
+	case sg := <-sig:
+		log.Printf("%s: shutting down with %d requests in flight (timeout %s)", sg, s.inFlight.Load(), cfg.ShutdownTimeout)
+	}
+	s.drain()
+	sctx, scancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	if err := srv.Shutdown(sctx); err != nil {
+		log.Printf("shutdown: %v; %d requests cut off", err, s.inFlight.Load())
+	}
+	scancel()
+	s.close()
+}
+
+// padUntil sleeps until t unless ctx ends first.
+func padUntil(ctx context.Context, t time.Time) {
+	d := time.Until(t)
+	if d <= 0 {
+		return
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+}
+
+// expiresIn is the token's remaining lifetime in seconds, assuming an hour
+// when Google omits the expiry.
+func expiresIn(tok *oauth2.Token) int {
+	if tok.Expiry.IsZero() {
+		return 3600
+	}
+	if d := time.Until(tok.Expiry); d > 0 {
+		return int(d.Seconds())
+	}
+	return 0
+}
+
+// tokenFingerprint is a short, non-reversible correlation id for a token:
+// the first 8 bytes of its SHA-256, hex encoded.
+func tokenFingerprint(tok string) string {
+	sum := sha256.Sum256([]byte(tok))
+	return hex.EncodeToString(sum[:8])
 }
 
 func seconds(d time.Duration) string {
@@ -358,3 +2338,9 @@ func seconds(d time.Duration) string {
 	}
 	return strconv.Itoa(s)
 }
+
+// isJSON reports whether the request body is declared as JSON.
+func isJSON(r *http.Request) bool {
+	mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mt == "application/json"
+}
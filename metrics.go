@@ -0,0 +1,192 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	maxDomainLabels = 20
+	domainUnknown   = "unknown" // identity not yet established
+	domainNone      = "none"    // consumer account without hd
+	domainOther     = "other"   // hd outside the configured set
+)
+
+// ------- metrics -------
+var (
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tokenbroker_requests_total",
+		Help: "Requests received, by route (unregistered paths are \"unknown\") and method.",
+	}, []string{"route", "method"})
+	responsesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tokenbroker_responses_total",
+		Help: "Responses sent, by route and HTTP status code.",
+	}, []string{"route", "code"})
+	verifyFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tokenbroker_oidc_verify_failures_total",
+		Help: "ID tokens that failed verification, by reason (invalid, expired, not_yet_valid, unknown_issuer, shutting_down).",
+	}, []string{"reason"})
+	verifyCacheLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tokenbroker_verify_cache_lookups_total",
+		Help: "Verified-token cache lookups by result (hit, miss).",
+	}, []string{"result"})
+	mintFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tokenbroker_mint_failures_total",
+		Help: "Token mints that failed after retries, by route.",
+	}, []string{"route"})
+	mintDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "tokenbroker_mint_duration_seconds",
+		Help:    "Token mint latency including retries, by route.",
+		Buckets: []float64{.025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+	}, []string{"route"})
+	auditDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "tokenbroker_audit_dropped_total",
+		Help: "Audit records dropped because the audit buffer was full.",
+	})
+	webhookEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tokenbroker_issuance_webhook_events_total",
+		Help: "Issuance webhook events by result (delivered, failed, dropped).",
+	}, []string{"result"})
+	missingUserAgent = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tokenbroker_missing_user_agent_total",
+		Help: "Requests to authenticated routes that carried no User-Agent.",
+	}, []string{"route"})
+	rateLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tokenbroker_rate_limited_total",
+		Help: "Requests rejected by a rate limiter, by limiter and caller domain.",
+	}, []string{"limiter", "domain"})
+	redisFallbacks = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tokenbroker_redis_fallback_total",
+		Help: "Rate limit decisions made by REDIS_FALLBACK because Redis was unavailable, by mode.",
+	}, []string{"mode"})
+	mintRetriesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "tokenbroker_mint_retries_total",
+		Help: "Token mint attempts retried after a transient failure.",
+	})
+	tokensIssued = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tokenbroker_tokens_issued_total",
+		Help: "Access tokens issued, by route and caller domain.",
+	}, []string{"route", "domain"})
+	deniedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tokenbroker_denied_total",
+		Help: "Requests rejected by a denylist or allow-list, by list (ip, subject or allowlist).",
+	}, []string{"list"})
+	clientGone = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tokenbroker_client_gone_total",
+		Help: "Mints skipped because the client disconnected first, by route.",
+	}, []string{"route"})
+	panicsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tokenbroker_panics_total",
+		Help: "Handler panics recovered into a 500, by route.",
+	}, []string{"route"})
+	shadowRejections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tokenbroker_shadow_rejections_total",
+		Help: "Requests a SHADOW_MODE gate would have rejected but let through, by gate.",
+	}, []string{"gate"})
+	replayRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tokenbroker_replay_rejected_total",
+		Help: "ID tokens refused by REPLAY_PROTECTION after REPLAY_MAX_USES mints, by route.",
+	}, []string{"route"})
+	overloaded = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tokenbroker_overloaded_total",
+		Help: "Requests shed with 503 because MAX_INFLIGHT requests were in flight, by route.",
+	}, []string{"route"})
+	xffChainMismatch = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "tokenbroker_xff_chain_mismatch_total",
+		Help: "Requests whose X-Forwarded-For had fewer entries than XFF_TRUSTED_HOPS.",
+	})
+	tokenTTL = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "tokenbroker_token_ttl_seconds",
+		Help:    "expires_in of issued tokens, by route.",
+		Buckets: []float64{60, 300, 600, 900, 1200, 1800, 2400, 3000, 3300, 3600},
+	}, []string{"route"})
+	scopesNarrowed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tokenbroker_scopes_narrowed_total",
+		Help: "Tokens granted with fewer scopes than requested, by route.",
+	}, []string{"route"})
+)
+
+func init() {
+	prometheus.MustRegister(requestsTotal, responsesTotal, verifyFailures, verifyCacheLookups, mintFailures, mintDuration, auditDropped, webhookEvents, missingUserAgent, rateLimited, redisFallbacks, tokensIssued, mintRetriesTotal, deniedTotal, clientGone, scopesNarrowed, xffChainMismatch, tokenTTL, panicsTotal, overloaded, replayRejected, shadowRejections)
+}
+
+// methodLabel keeps the method label to the standard methods.
+func methodLabel(m string) string {
+	switch m {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodOptions:
+		return m
+	}
+	return "other"
+}
+
+// statusRecorder remembers the status code written through it.
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if s.code == 0 {
+		s.code = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(p []byte) (int, error) {
+	if s.code == 0 {
+		s.code = http.StatusOK
+	}
+	return s.ResponseWriter.Write(p)
+}
+
+func (s *statusRecorder) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the connection.
+func (s *statusRecorder) Unwrap() http.ResponseWriter { return s.ResponseWriter }
+
+func (s *statusRecorder) status() int {
+	if s.code == 0 {
+		return http.StatusOK
+	}
+	return s.code
+}
+
+// domainLabels caps the domain label to a configured set so arbitrary hosted
+// domains can't blow up metric cardinality.
+type domainLabels map[string]bool
+
+func newDomainLabels(domains []string) domainLabels {
+	d := make(domainLabels)
+	for _, v := range domains {
+		v = strings.ToLower(strings.TrimSpace(v))
+		if v == "" || d[v] {
+			continue
+		}
+		if len(d) == maxDomainLabels {
+			log.Printf("METRICS_DOMAINS: more than %d domains, ignoring %s", maxDomainLabels, v)
+			continue
+		}
+		d[v] = true
+	}
+	return d
+}
+
+func (d domainLabels) label(hd string) string {
+	hd = strings.ToLower(strings.TrimSpace(hd))
+	switch {
+	case hd == "":
+		return domainNone
+	case d[hd]:
+		return hd
+	default:
+		return domainOther
+	}
+}
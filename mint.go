@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// ------- mint retries -------
+
+// mintWithRetry calls mint, retrying transient failures up to retries times
+// with jittered exponential backoff. It never sleeps past ctx's deadline.
+func mintWithRetry(ctx context.Context, retries int, backoff time.Duration, mint func() (*oauth2.Token, error)) (*oauth2.Token, error) {
+	route, start := routeFrom(ctx), time.Now()
+	tok, err := mintAttempts(ctx, retries, backoff, mint)
+	mintDuration.WithLabelValues(route).Observe(time.Since(start).Seconds())
+	if err != nil {
+		mintFailures.WithLabelValues(route).Inc()
+	}
+	return tok, err
+}
+
+func mintAttempts(ctx context.Context, retries int, backoff time.Duration, mint func() (*oauth2.Token, error)) (*oauth2.Token, error) {
+	for attempt := 0; ; attempt++ {
+		tok, err := mint()
+		if err == nil || attempt >= retries || !retryableMintError(err) {
+			return tok, err
+		}
+		// full jitter over an exponentially growing window
+		sleep := time.Duration(rand.Int64N(int64(backoff<<attempt) + 1))
+		if dl, ok := ctx.Deadline(); ok && time.Now().Add(sleep).After(dl) {
+			return nil, err
+		}
+		mintRetriesTotal.Inc()
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(sleep):
+		}
+	}
+}
+
+// retryableMintError reports whether err looks transient: 5xx/429 from the
+// token endpoint, timeouts or other network failures. Auth and permission
+// errors (other 4xx) are final.
+func retryableMintError(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var re *oauth2.RetrieveError
+	if errors.As(err, &re) {
+		if re.Response == nil {
+			return false
+		}
+		code := re.Response.StatusCode
+		return code >= 500 || code == http.StatusTooManyRequests
+	}
+	var ne net.Error
+	return errors.As(err, &ne)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// ------- token minters -------
+
+// Minter turns a verified identity into an access token for scopes. The
+// Google service-account minter is the default; other backends (AWS STS,
+// Azure AD, …) can be compiled in by implementing this interface.
+type Minter interface {
+	Mint(ctx context.Context, claims whoamiResp, scopes []string) (*oauth2.Token, error)
+}
+
+type lifetimeCtxKey struct{}
+
+// withLifetime asks minters for a token lifetime shorter than their default.
+// Minters that can't (the SA key's JWT flow) ignore it, and the handler
+// clamps the reported expires_in instead.
+func withLifetime(ctx context.Context, d time.Duration) context.Context {
+	if d <= 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, lifetimeCtxKey{}, d)
+}
+
+// lifetimeFrom returns the requested lifetime, or 0 for the default.
+func lifetimeFrom(ctx context.Context) time.Duration {
+	d, _ := ctx.Value(lifetimeCtxKey{}).(time.Duration)
+	return d
+}
+
+// parseLifetime reads a requested lifetime in whole seconds; "" (or 0 from
+// a JSON body) means the default. Lifetimes above max are rejected.
+func parseLifetime(v string, max time.Duration) (time.Duration, error) {
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, errors.New("lifetime must be a whole number of seconds")
+	}
+	d := time.Duration(n) * time.Second
+	if d > max {
+		return 0, fmt.Errorf("lifetime exceeds the %ds maximum", int(max.Seconds()))
+	}
+	return d, nil
+}
+
+// clampTTL caps an expires_in at the requested lifetime, if any.
+func clampTTL(ttl int, lifetime time.Duration) int {
+	if s := int(lifetime.Seconds()); lifetime > 0 && ttl > s {
+		return s
+	}
+	return ttl
+}
+
+// googleMinter mints a fresh SA token per call from the per-scope-set
+// source (the SA key's JWT config, or IMPERSONATE_SA_EMAIL). The caller's
+// identity is not forwarded; the SA is the principal. Google's token
+// response omits scopes, so the source's are attached as the token's
+// "scope" extra.
+type googleMinter struct {
+	sources *scopeSources
+	out     *egress
+}
+
+func (m *googleMinter) Mint(ctx context.Context, _ whoamiResp, scopes []string) (*oauth2.Token, error) {
+	src, err := m.sources.get(scopes...)
+	if err != nil {
+		return nil, err
+	}
+	tok, err := src.newTS(m.out.ctx(ctx)).Token()
+	if err != nil {
+		return nil, err
+	}
+	return tok.WithExtra(map[string]any{"scope": strings.Join(src.scopes, " ")}), nil
+}
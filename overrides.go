@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"golang.org/x/time/rate"
+)
+
+// ------- per-key limiter overrides -------
+
+// limitOverride is one entry of LIMITER_OVERRIDES_FILE.
+type limitOverride struct {
+	PerMin int `json:"per_min"`
+	Burst  int `json:"burst"`
+}
+
+type overrideSet struct {
+	gen      uint64
+	exact    map[string]limitOverride
+	prefixes map[string]limitOverride // key prefix (without the trailing "*")
+}
+
+// limiterOverrides maps limiter keys ("user:<sub>", "ip:<addr>") to custom
+// limits. Keys ending in "*" match by prefix; exact keys win, then the
+// longest prefix. The set is replaced atomically on reload.
+type limiterOverrides struct {
+	path string
+	set  atomic.Pointer[overrideSet]
+}
+
+func newLimiterOverrides(path string) (*limiterOverrides, error) {
+	o := &limiterOverrides{path: path}
+	if err := o.reload(); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+func (o *limiterOverrides) reload() error {
+	buf, err := os.ReadFile(o.path)
+	if err != nil {
+		return err
+	}
+	var raw map[string]limitOverride
+	if err := json.Unmarshal(buf, &raw); err != nil {
+		return fmt.Errorf("parse %s: %w", o.path, err)
+	}
+	next := &overrideSet{
+		exact:    make(map[string]limitOverride),
+		prefixes: make(map[string]limitOverride),
+	}
+	if cur := o.set.Load(); cur != nil {
+		next.gen = cur.gen + 1
+	}
+	for k, v := range raw {
+		if v.PerMin <= 0 || v.Burst <= 0 {
+			return fmt.Errorf("override %q: per_min and burst must be positive", k)
+		}
+		if p, ok := strings.CutSuffix(k, "*"); ok {
+			next.prefixes[p] = v
+		} else {
+			next.exact[k] = v
+		}
+	}
+	o.set.Store(next)
+	return nil
+}
+
+// lookup returns the override for key and the generation of the set it came
+// from, so callers can detect a reload.
+func (o *limiterOverrides) lookup(key string) (limitOverride, bool, uint64) {
+	if o == nil {
+		return limitOverride{}, false, 0
+	}
+	set := o.set.Load()
+	if v, ok := set.exact[key]; ok {
+		return v, true, set.gen
+	}
+	best, found := "", false
+	for p := range set.prefixes {
+		if strings.HasPrefix(key, p) && (!found || len(p) > len(best)) {
+			best, found = p, true
+		}
+	}
+	if found {
+		return set.prefixes[best], true, set.gen
+	}
+	return limitOverride{}, false, set.gen
+}
+
+func (o *limiterOverrides) generation() uint64 {
+	return o.set.Load().gen
+}
+
+func (v limitOverride) limit() rate.Limit {
+	return rate.Limit(float64(v.PerMin) / 60.0)
+}
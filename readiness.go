@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// ------- readiness -------
+
+// readiness backs /readyz. With afterMint set the instance is not ready until
+// a token has been minted, so traffic isn't routed to it while fresh SA
+// credentials are still propagating. With maxFailures set, that many
+// consecutive failed mints also make it unready; since an unready instance
+// gets no traffic, probe (run once per outage) mints until one succeeds.
+type readiness struct {
+	afterMint bool
+	minted    atomic.Bool
+
+	maxFailures int64
+	failures    atomic.Int64
+	probing     atomic.Bool
+	probe       func()
+}
+
+func (rd *readiness) ready() bool {
+	if rd.maxFailures > 0 && rd.failures.Load() >= rd.maxFailures {
+		return false
+	}
+	return !rd.afterMint || rd.minted.Load()
+}
+
+func (rd *readiness) markMinted() {
+	if n := rd.failures.Swap(0); rd.maxFailures > 0 && n >= rd.maxFailures {
+		log.Printf("mint succeeded after %d consecutive failures; ready", n)
+	}
+	if rd.minted.CompareAndSwap(false, true) && rd.afterMint {
+		log.Printf("first token minted; ready")
+	}
+}
+
+func (rd *readiness) markFailed() {
+	n := rd.failures.Add(1)
+	if rd.maxFailures <= 0 || n < rd.maxFailures {
+		return
+	}
+	if n == rd.maxFailures {
+		log.Printf("%d consecutive mint failures; not ready", n)
+	}
+	if rd.probe != nil && rd.probing.CompareAndSwap(false, true) {
+		go func() {
+			defer rd.probing.Store(false)
+			rd.probe()
+		}()
+	}
+}
+
+// readyMinter reports every mint to readiness. A mint cut short by its own
+// context (the caller went away) says nothing about the credentials and is
+// not counted as a failure.
+type readyMinter struct {
+	Minter
+	rd *readiness
+}
+
+func (m readyMinter) Mint(ctx context.Context, claims whoamiResp, scopes []string) (*oauth2.Token, error) {
+	tok, err := m.Minter.Mint(ctx, claims, scopes)
+	switch {
+	case err == nil:
+		m.rd.markMinted()
+	case ctx.Err() == nil:
+		m.rd.markFailed()
+	}
+	return tok, err
+}
+
+// selfTestMint mints scope once for STARTUP_SELFTEST. Unlike warmupMint it
+// doesn't retry: credentials that can't mint now fail the start.
+func selfTestMint(ctx context.Context, m Minter, scope string) error {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	tok, err := m.Mint(ctx, whoamiResp{}, []string{scope})
+	if err == nil && tok.AccessToken == "" {
+		err = errors.New("empty access token")
+	}
+	return err
+}
+
+// warmupMint mints scope, retrying with backoff until it succeeds or ctx
+// ends: once at startup so readiness doesn't wait for the first real caller,
+// and as the readiness probe after READY_MINT_FAILURES.
+func warmupMint(ctx context.Context, m Minter, scope string) {
+	backoff := 500 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		actx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		_, err := m.Mint(actx, whoamiResp{}, []string{scope})
+		cancel()
+		if err == nil {
+			log.Printf("warmup mint succeeded after %d attempts", attempt)
+			return
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("warmup mint attempt %d: %v; retrying in %s", attempt, err, backoff)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, 30*time.Second)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+)
+
+// ------- panic recovery -------
+
+// recoverPanics turns a panicking handler into a logged 500 internal_error
+// instead of a dropped connection. The stack trace is logged with the
+// request ID. If the response had already started, it can only be cut
+// short. http.ErrAbortHandler is passed through, since it's how a handler
+// deliberately aborts.
+func recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rw := &panicWriter{ResponseWriter: w}
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if err, ok := v.(error); ok && errors.Is(err, http.ErrAbortHandler) {
+				panic(v)
+			}
+			panicsTotal.WithLabelValues(routeOf(r)).Inc()
+			slog.ErrorContext(r.Context(), "handler panic",
+				"request_id", requestIDOf(r.Context()), "route", routeOf(r),
+				"panic", v, "stack", string(debug.Stack()))
+			if rw.wrote {
+				panic(http.ErrAbortHandler)
+			}
+			writeJSONError(w, http.StatusInternalServerError, codeInternal, "")
+		}()
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// panicWriter notes whether the response has started.
+type panicWriter struct {
+	http.ResponseWriter
+	wrote bool
+}
+
+func (p *panicWriter) WriteHeader(code int) {
+	p.wrote = true
+	p.ResponseWriter.WriteHeader(code)
+}
+
+func (p *panicWriter) Write(b []byte) (int, error) {
+	p.wrote = true
+	return p.ResponseWriter.Write(b)
+}
+
+func (p *panicWriter) Unwrap() http.ResponseWriter { return p.ResponseWriter }
+
+func (p *panicWriter) Flush() {
+	if f, ok := p.ResponseWriter.(http.Flusher); ok {
+		p.wrote = true
+		f.Flush()
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// ------- shared (Redis) rate limiting -------
+
+// REDIS_FALLBACK modes: what a shared limiter does while Redis is unreachable.
+const (
+	fallbackLocal      = "local"       // the replica's own in-memory buckets
+	fallbackFailOpen   = "fail_open"   // allow everything
+	fallbackFailClosed = "fail_closed" // reject everything (429)
+)
+
+// tokenBucketScript charges ARGV[3] tokens from the bucket at KEYS[1]
+// (rate ARGV[1]/s, burst ARGV[2]; a new bucket starts with ARGV[4]) using
+// the Redis clock, so replicas with skewed clocks agree. It returns
+// {allowed, tokens left, seconds until n tokens are available or -1}.
+const tokenBucketScript = `
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local n = tonumber(ARGV[3])
+local t = redis.call('TIME')
+local now = tonumber(t[1]) + tonumber(t[2]) / 1000000
+local b = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens, ts = tonumber(b[1]), tonumber(b[2])
+if tokens == nil or ts == nil then
+  tokens, ts = tonumber(ARGV[4]), now
+end
+tokens = math.min(burst, tokens + math.max(0, now - ts) * rate)
+local allowed, wait = 0, -1
+if n <= tokens then
+  tokens = tokens - n
+  allowed, wait = 1, 0
+elseif rate > 0 and n <= burst then
+  wait = (n - tokens) / rate
+end
+redis.call('HSET', KEYS[1], 'tokens', tokens, 'ts', now)
+local ttl = 60000
+if rate > 0 then ttl = math.ceil(burst / rate * 1000) + 1000 end
+redis.call('PEXPIRE', KEYS[1], ttl)
+return {allowed, tostring(tokens), tostring(wait)}
+`
+
+// counterScript adds ARGV[2] to KEYS[1], starting its ARGV[1] ms expiry when
+// the key is new, and returns the new count.
+const counterScript = `
+local n = redis.call('INCRBY', KEYS[1], ARGV[2])
+if redis.call('PTTL', KEYS[1]) < 0 then redis.call('PEXPIRE', KEYS[1], ARGV[1]) end
+return n
+`
+
+var tokenBucketSHA = func() string {
+	sum := sha1.Sum([]byte(tokenBucketScript))
+	return hex.EncodeToString(sum[:])
+}()
+
+// redisLimiter keeps token buckets in Redis so every replica charges the
+// same budget. When a call fails, the registry applies fallback; the first
+// failure and the recovery are logged once each rather than per request.
+// While down, Redis is retried at most once per redisRetryInterval, so an
+// outage doesn't add a timeout to every request.
+type redisLimiter struct {
+	client   *redisClient
+	prefix   string
+	fallback string
+	down     atomic.Bool
+	retryAt  atomic.Int64 // unix nanos; while down, calls before this fail fast
+}
+
+const redisRetryInterval = time.Second
+
+var errRedisDown = errors.New("redis: unavailable")
+
+func newRedisLimiter(client *redisClient, prefix, fallback string) *redisLimiter {
+	return &redisLimiter{client: client, prefix: prefix, fallback: fallback}
+}
+
+// take charges n tokens from key's bucket. wait is how long until n tokens
+// will be available, or negative if they never will (n > burst).
+func (rl *redisLimiter) take(key string, n int, rps rate.Limit, burst, cold int) (ok bool, tokens float64, wait time.Duration, err error) {
+	if rl.down.Load() && time.Now().UnixNano() < rl.retryAt.Load() {
+		return false, 0, 0, errRedisDown
+	}
+	args := []string{"EVALSHA", tokenBucketSHA, "1", rl.prefix + key,
+		strconv.FormatFloat(float64(rps), 'g', -1, 64), strconv.Itoa(burst), strconv.Itoa(n), strconv.Itoa(cold)}
+	reply, err := rl.client.do(context.Background(), args...)
+	var rerr redisError
+	if errors.As(err, &rerr) && strings.HasPrefix(string(rerr), "NOSCRIPT") {
+		args[0], args[1] = "EVAL", tokenBucketScript
+		reply, err = rl.client.do(context.Background(), args...)
+	}
+	if err == nil {
+		ok, tokens, wait, err = parseBucketReply(reply)
+	}
+	if err != nil {
+		rl.markDown(err)
+		return false, 0, 0, err
+	}
+	rl.markUp()
+	return ok, tokens, wait, nil
+}
+
+// incr adds by (negative to give events back) to the count under key,
+// forgotten ttl after the first event.
+func (rl *redisLimiter) incr(key string, by int64, ttl time.Duration) (int64, error) {
+	if rl.down.Load() && time.Now().UnixNano() < rl.retryAt.Load() {
+		return 0, errRedisDown
+	}
+	reply, err := rl.client.do(context.Background(), "EVAL", counterScript, "1", rl.prefix+key, strconv.FormatInt(ttl.Milliseconds(), 10), strconv.FormatInt(by, 10))
+	n, ok := reply.(int64)
+	if err == nil && !ok {
+		err = fmt.Errorf("redis: unexpected counter reply %v", reply)
+	}
+	if err != nil {
+		rl.markDown(err)
+		return 0, err
+	}
+	rl.markUp()
+	return n, nil
+}
+
+func parseBucketReply(reply any) (ok bool, tokens float64, wait time.Duration, err error) {
+	vals, _ := reply.([]any)
+	if len(vals) != 3 {
+		return false, 0, 0, fmt.Errorf("redis: unexpected bucket reply %v", reply)
+	}
+	allowed, _ := vals[0].(int64)
+	t, terr := strconv.ParseFloat(fmt.Sprint(vals[1]), 64)
+	w, werr := strconv.ParseFloat(fmt.Sprint(vals[2]), 64)
+	if terr != nil || werr != nil {
+		return false, 0, 0, fmt.Errorf("redis: unexpected bucket reply %v", reply)
+	}
+	if w < 0 {
+		return allowed == 1, t, -1, nil
+	}
+	return allowed == 1, t, time.Duration(w * float64(time.Second)), nil
+}
+
+func (rl *redisLimiter) markDown(err error) {
+	rl.retryAt.Store(time.Now().Add(redisRetryInterval).UnixNano())
+	if rl.down.CompareAndSwap(false, true) {
+		log.Printf("WARNING: redis rate limiter unavailable (%v); falling back to %s", err, rl.fallback)
+	}
+}
+
+func (rl *redisLimiter) markUp() {
+	if rl.down.CompareAndSwap(true, false) {
+		log.Printf("redis rate limiter reachable again")
+	}
+}
+
+// ping checks Redis for /readyz, updating the down state either way.
+func (rl *redisLimiter) ping(ctx context.Context) error {
+	err := rl.client.ping(ctx)
+	if err != nil {
+		rl.markDown(err)
+		return err
+	}
+	rl.markUp()
+	return nil
+}
+
+func (rl *redisLimiter) close() {
+	if rl != nil {
+		rl.client.close()
+	}
+}
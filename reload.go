@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// ------- SIGHUP reload -------
+type reloader struct {
+	name string
+	fn   func() error
+}
+
+// reloadOnSIGHUP re-runs every reloader each time the process receives SIGHUP.
+// A failed reload is logged and the previous state is kept.
+func reloadOnSIGHUP(ctx context.Context, rs []reloader) {
+	if len(rs) == 0 {
+		return
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			for _, r := range rs {
+				if err := r.fn(); err != nil {
+					log.Printf("reload %s: %v", r.name, err)
+					continue
+				}
+				log.Printf("reloaded %s", r.name)
+			}
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ------- ID token replay protection -------
+
+// replayGuard counts how often each ID token has been used to mint, keyed
+// by a hash of its signature, and refuses it after max uses. A use is
+// remembered until the token expires (plus the verifier's skew), after
+// which the token is rejected on its own. With REDIS_URL the counts live
+// in Redis next to the rate limits, so every replica sees the same uses.
+type replayGuard struct {
+	max    int
+	skew   time.Duration
+	shared *redisLimiter
+
+	mu   sync.Mutex
+	uses map[string]replayUses
+}
+
+type replayUses struct {
+	n       int
+	expires time.Time
+}
+
+func newReplayGuard(max int, skew time.Duration, shared *redisLimiter) *replayGuard {
+	return &replayGuard{max: max, skew: skew, shared: shared, uses: make(map[string]replayUses)}
+}
+
+// replayKey hashes the signature segment: it is unique per token and, unlike
+// jti, present in every provider's tokens.
+func replayKey(raw string) string {
+	sig := raw[strings.LastIndex(raw, ".")+1:]
+	sum := sha256.Sum256([]byte(sig))
+	return hex.EncodeToString(sum[:16])
+}
+
+// replayUse is one use held by reserve. It is given back by settle unless
+// keep was called, so only mints that succeed spend a use. A nil replayUse
+// (nothing recorded) is valid.
+type replayUse struct {
+	g      *replayGuard
+	key    string
+	ttl    time.Duration
+	shared bool // counted in Redis rather than g.uses
+	kept   bool
+}
+
+// reserve holds one use of raw, valid until expiry, and reports whether it
+// is still within max; a refused use is given back at once. Defer settle on
+// the result and call keep once the mint has succeeded. A nil guard allows
+// everything.
+func (g *replayGuard) reserve(raw string, expiry time.Time) (*replayUse, bool) {
+	if g == nil {
+		return nil, true
+	}
+	key, ttl := replayKey(raw), time.Until(expiry)+g.skew
+	if ttl <= 0 {
+		ttl = time.Second
+	}
+	if g.shared != nil {
+		n, err := g.shared.incr("replay:"+key, 1, ttl)
+		if err == nil {
+			u := &replayUse{g: g, key: key, ttl: ttl, shared: true}
+			if n > int64(g.max) {
+				u.settle()
+				return nil, false
+			}
+			return u, true
+		}
+		redisFallbacks.WithLabelValues(g.shared.fallback).Inc()
+		switch g.shared.fallback {
+		case fallbackFailOpen:
+			return nil, true
+		case fallbackFailClosed:
+			return nil, false
+		}
+	}
+	now := time.Now()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	u := g.uses[key]
+	if u.expires.Before(now) {
+		u = replayUses{expires: now.Add(ttl)}
+	}
+	if u.n >= g.max {
+		return nil, false
+	}
+	u.n++
+	g.uses[key] = u
+	return &replayUse{g: g, key: key, ttl: ttl}, true
+}
+
+// keep spends the use.
+func (u *replayUse) keep() {
+	if u != nil {
+		u.kept = true
+	}
+}
+
+// settle gives the use back unless it was kept.
+func (u *replayUse) settle() {
+	if u == nil || u.kept {
+		return
+	}
+	u.kept = true
+	if u.shared {
+		// if Redis is down now the use stays spent; failing safe is fine here
+		_, _ = u.g.shared.incr("replay:"+u.key, -1, u.ttl)
+		return
+	}
+	u.g.mu.Lock()
+	defer u.g.mu.Unlock()
+	if c, ok := u.g.uses[u.key]; ok && c.n > 0 {
+		c.n--
+		u.g.uses[u.key] = c
+	}
+}
+
+// cleanupLoop forgets expired tokens every minute.
+func (g *replayGuard) cleanupLoop(ctx context.Context) {
+	t := time.NewTicker(time.Minute)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			g.sweep(time.Now())
+		}
+	}
+}
+
+func (g *replayGuard) sweep(now time.Time) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for k, u := range g.uses {
+		if u.expires.Before(now) {
+			delete(g.uses, k)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReplayProtection(t *testing.T) {
+	signer := newTestSigner(t, "k1")
+	cfg := testConfig(t, map[string]string{"REPLAY_PROTECTION": "true", "REPLAY_MAX_USES": "2"})
+	s := newTestServer(t, cfg, newFakeVerifier(signer), &fakeMinter{}, nil)
+	get := func(raw string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/token", nil)
+		req.Header.Set("Authorization", "Bearer "+raw)
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		return rec
+	}
+
+	stolen := signer.sign(t, idClaims(nil))
+	for i := 0; i < 2; i++ {
+		if rec := get(stolen); rec.Code != http.StatusOK {
+			t.Fatalf("use %d: %d %s", i+1, rec.Code, rec.Body)
+		}
+	}
+	if rec := get(stolen); rec.Code != http.StatusUnauthorized || !strings.Contains(rec.Body.String(), `"code":"token_replayed"`) {
+		t.Errorf("third use: %d %s, want 401 token_replayed", rec.Code, rec.Body)
+	}
+	// a freshly issued ID token for the same user is a different token
+	fresh := signer.sign(t, idClaims(map[string]any{"iat": time.Now().Unix() + 1}))
+	if rec := get(fresh); rec.Code != http.StatusOK {
+		t.Errorf("fresh token: %d %s", rec.Code, rec.Body)
+	}
+}
+
+func TestReplayOnlyMintsSpendUses(t *testing.T) {
+	signer := newTestSigner(t, "k1")
+	cfg := testConfig(t, map[string]string{"REPLAY_PROTECTION": "true", "REPLAY_MAX_USES": "1", "MINT_RETRIES": "0"})
+	minter := &flakyMinter{}
+	s := newTestServer(t, cfg, newFakeVerifier(signer), minter, nil)
+	raw := signer.sign(t, idClaims(nil))
+	get := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Authorization", "Bearer "+raw)
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for i := 0; i < 2; i++ {
+		if rec := get("/ratelimit"); rec.Code != http.StatusOK {
+			t.Fatalf("/ratelimit %d: %d %s", i+1, rec.Code, rec.Body)
+		}
+	}
+	minter.fail.Store(true)
+	if rec := get("/token"); rec.Code != http.StatusInternalServerError {
+		t.Fatalf("failed mint: %d %s, want 500", rec.Code, rec.Body)
+	}
+	minter.fail.Store(false)
+	if rec := get("/token"); rec.Code != http.StatusOK {
+		t.Fatalf("only use after /ratelimit and a failed mint: %d %s", rec.Code, rec.Body)
+	}
+	if rec := get("/token"); rec.Code != http.StatusUnauthorized || !strings.Contains(rec.Body.String(), `"code":"token_replayed"`) {
+		t.Errorf("second mint: %d %s, want 401 token_replayed", rec.Code, rec.Body)
+	}
+}
+
+func TestReplayGuardShared(t *testing.T) {
+	f := newFakeRedis(t)
+	guard := func() *replayGuard {
+		client, err := parseRedisURL(f.url(), 200*time.Millisecond)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rl := newRedisLimiter(client, "test:rl:", fallbackLocal)
+		t.Cleanup(rl.close)
+		return newReplayGuard(1, 0, rl)
+	}
+	a, b := guard(), guard()
+	exp := time.Now().Add(time.Hour)
+	use, ok := a.reserve("h.p.sig", exp)
+	if !ok {
+		t.Fatal("first use refused")
+	}
+	if _, ok := b.reserve("h.p.sig", exp); ok {
+		t.Error("second replica accepted a token already held on the first")
+	}
+	// a use given back by a failed mint is free again on every replica
+	use.settle()
+	use, ok = b.reserve("h.p.sig", exp)
+	if !ok {
+		t.Fatal("use given back on the first replica still refused on the second")
+	}
+	use.keep()
+	use.settle()
+	if _, ok := a.reserve("h.p.sig", exp); ok {
+		t.Error("kept use was given back")
+	}
+	if len(a.uses) != 0 {
+		t.Error("shared guard recorded the use locally")
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"net/http"
+)
+
+// ------- request ids -------
+
+const requestIDHeader = "X-Request-ID"
+
+// requestIDFor returns the caller's X-Request-ID when it is a short, safe
+// token (so proxies can keep their id), or a fresh random one.
+func requestIDFor(r *http.Request) string {
+	if v := r.Header.Get(requestIDHeader); validRequestID(v) {
+		return v
+	}
+	var b [8]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+func validRequestID(v string) bool {
+	if v == "" || len(v) > 64 {
+		return false
+	}
+	for _, c := range v {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_', c == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+type requestIDCtxKey struct{}
+
+func withRequestID(r *http.Request, id string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), requestIDCtxKey{}, id))
+}
+
+func requestIDOf(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDCtxKey{}).(string)
+	return id
+}
+
+// requestIDTransport stamps outbound calls made on behalf of a request with
+// its id, and logs the id next to upstream failures so broker logs can be
+// matched with Google-side errors.
+type requestIDTransport struct {
+	base http.RoundTripper
+	id   string
+}
+
+func (t *requestIDTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set(requestIDHeader, t.id)
+	resp, err := t.base.RoundTrip(req)
+	switch {
+	case err != nil:
+		log.Printf("upstream request_id=%s %s %s: %v", t.id, req.Method, req.URL.Host, err)
+	case resp.StatusCode >= 400:
+		log.Printf("upstream request_id=%s %s %s%s: status %d", t.id, req.Method, req.URL.Host, req.URL.Path, resp.StatusCode)
+	}
+	return resp, err
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+const routeUnknown = "unknown"
+
+// ------- route labels -------
+
+// routeTable registers handlers on a mux and remembers each pattern as the
+// canonical, low-cardinality route label for logs and metrics, along with
+// the methods it serves. That one method list drives the 405 check, the
+// Allow header and the CORS Access-Control-Allow-Methods for the route.
+type routeTable struct {
+	mux     *http.ServeMux
+	labels  map[string]bool
+	methods map[string][]string
+}
+
+func newRouteTable() *routeTable {
+	return &routeTable{mux: http.NewServeMux(), labels: make(map[string]bool), methods: make(map[string][]string)}
+}
+
+func (rt *routeTable) handle(pattern string, methods []string, h http.Handler) {
+	rt.labels[pattern] = true
+	rt.methods[pattern] = methods
+	rt.mux.Handle(pattern, h)
+}
+
+func (rt *routeTable) handleFunc(pattern string, methods []string, h func(http.ResponseWriter, *http.Request)) {
+	rt.handle(pattern, methods, http.HandlerFunc(h))
+}
+
+// permits reports whether route serves method. OPTIONS is always handled by
+// the top-level handler; unknown routes are left to the mux (and 404).
+func (rt *routeTable) permits(route, method string) bool {
+	if route == routeUnknown || method == http.MethodOptions {
+		return true
+	}
+	return slices.Contains(rt.methods[route], method)
+}
+
+// allow is the Allow / Access-Control-Allow-Methods value for route.
+func (rt *routeTable) allow(route string) string {
+	return strings.Join(append(slices.Clone(rt.methods[route]), http.MethodOptions), ", ")
+}
+
+// label maps a request path to its registered route, or "unknown". Query
+// strings are never part of the label.
+func (rt *routeTable) label(path string) string {
+	if rt.labels[path] {
+		return path
+	}
+	return routeUnknown
+}
+
+type routeCtxKey struct{}
+
+func withRoute(r *http.Request, route string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), routeCtxKey{}, route))
+}
+
+// routeOf returns the label stored by the top-level handler.
+func routeOf(r *http.Request) string {
+	return routeFrom(r.Context())
+}
+
+func routeFrom(ctx context.Context) string {
+	if v, ok := ctx.Value(routeCtxKey{}).(string); ok {
+		return v
+	}
+	return routeUnknown
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// ------- per-caller scope policy -------
+
+// scopePolicyFile is the JSON shape of SCOPE_POLICY_FILE. A caller may use
+// the union of the scopes granted to their sub, email and hd; callers that
+// match nothing get default (none when omitted).
+type scopePolicyFile struct {
+	Subjects map[string][]string `json:"subjects"`
+	Emails   map[string][]string `json:"emails"`
+	Domains  map[string][]string `json:"domains"`
+	Default  []string            `json:"default"`
+}
+
+type scopeGrants map[string]map[string]bool // key → scope set
+
+type scopePolicySet struct {
+	subjects, emails, domains scopeGrants
+	def                       map[string]bool
+}
+
+// scopePolicy answers which scopes a verified caller may request. The set
+// is replaced atomically on reload.
+type scopePolicy struct {
+	path   string
+	emails emailMatch
+	set    atomic.Pointer[scopePolicySet]
+}
+
+func newScopePolicy(path string, emails emailMatch) (*scopePolicy, error) {
+	p := &scopePolicy{path: path, emails: emails}
+	if err := p.reload(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *scopePolicy) reload() error {
+	buf, err := os.ReadFile(p.path)
+	if err != nil {
+		return err
+	}
+	var raw scopePolicyFile
+	if err := json.Unmarshal(buf, &raw); err != nil {
+		return fmt.Errorf("parse %s: %w", p.path, err)
+	}
+	grants := func(m map[string][]string, norm func(string) string) scopeGrants {
+		out := make(scopeGrants, len(m))
+		for k, scopes := range m {
+			out[norm(k)] = toSet(scopes)
+		}
+		return out
+	}
+	p.set.Store(&scopePolicySet{
+		subjects: grants(raw.Subjects, strings.TrimSpace),
+		emails:   grants(raw.Emails, p.emails.normalize),
+		domains:  grants(raw.Domains, func(d string) string { return strings.ToLower(strings.TrimSpace(d)) }),
+		def:      toSet(raw.Default),
+	})
+	return nil
+}
+
+// denied returns the first scope the caller isn't permitted, or "" when all
+// are. A nil policy permits everything.
+func (p *scopePolicy) denied(c whoamiResp, scopes []string) string {
+	if p == nil {
+		return ""
+	}
+	set := p.set.Load()
+	var granted []map[string]bool
+	if g, ok := set.subjects[c.Subject]; ok {
+		granted = append(granted, g)
+	}
+	if g, ok := set.emails[p.emails.normalize(c.Email)]; ok && c.Email != "" {
+		granted = append(granted, g)
+	}
+	if g, ok := set.domains[strings.ToLower(c.HD)]; ok && c.HD != "" {
+		granted = append(granted, g)
+	}
+	if len(granted) == 0 {
+		granted = append(granted, set.def)
+	}
+next:
+	for _, sc := range scopes {
+		for _, g := range granted {
+			if g[sc] {
+				continue next
+			}
+		}
+		return sc
+	}
+	return ""
+}
+
+func toSet(vals []string) map[string]bool {
+	out := make(map[string]bool, len(vals))
+	for _, v := range vals {
+		out[strings.TrimSpace(v)] = true
+	}
+	return out
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+// ------- per-scope token sources -------
+
+// scopedSource is a token source bound to one scope set; scopes is exactly
+// what gets minted. newTS builds an unshared source for callers that want a
+// fresh token on their own context rather than the cached one.
+type scopedSource struct {
+	scopes []string
+	newTS  func(context.Context) oauth2.TokenSource
+	ts     oauth2.TokenSource
+}
+
+func (s *scopedSource) Token() (*oauth2.Token, error) {
+	return s.ts.Token()
+}
+
+// scopeSources lazily builds one cached token source per scope set. Scopes
+// are bound when the source is built, so each set gets its own (for the SA
+// key, its own google.JWTConfigFromJSON) rather than reusing the startup
+// TOKEN_SCOPE config. Each source reuses its token until shortly before expiry.
+type scopeSources struct {
+	ctx   context.Context // carries the outbound HTTP client
+	build func(scopes []string) (func(context.Context) oauth2.TokenSource, error)
+	// buildID mints ID tokens for an audience; nil when the credentials can't
+	buildID func(ctx context.Context, audience string) oauth2.TokenSource
+	mu      sync.Mutex
+	src     map[string]*scopedSource
+	ids     map[string]oauth2.TokenSource
+}
+
+// newScopeSources mints with the credentials in saJSON: a service account
+// key, or (see credentials.go) an external account or impersonation config.
+func newScopeSources(ctx context.Context, saJSON []byte) *scopeSources {
+	if t, _ := credentialsType(saJSON); t != credServiceAccount {
+		return newCredentialSources(ctx, saJSON)
+	}
+	return &scopeSources{ctx: ctx, src: make(map[string]*scopedSource),
+		build: func(scopes []string) (func(context.Context) oauth2.TokenSource, error) {
+			conf, err := google.JWTConfigFromJSON(saJSON, scopes...)
+			if err != nil {
+				return nil, err
+			}
+			return conf.TokenSource, nil
+		},
+		buildID: func(ctx context.Context, audience string) oauth2.TokenSource {
+			conf, err := google.JWTConfigFromJSON(saJSON)
+			if err != nil {
+				return errorSource{err}
+			}
+			return &keyIDTokenSource{ctx: ctx, conf: conf, audience: audience}
+		},
+	}
+}
+
+// newImpersonatedSources mints as target through generateAccessToken,
+// authenticated by the ADC source base.
+func newImpersonatedSources(ctx context.Context, base oauth2.TokenSource, target string, lifetime time.Duration) *scopeSources {
+	return &scopeSources{ctx: ctx, src: make(map[string]*scopedSource),
+		build: func(scopes []string) (func(context.Context) oauth2.TokenSource, error) {
+			return func(ctx context.Context) oauth2.TokenSource {
+				d := lifetime
+				if l := lifetimeFrom(ctx); l > 0 {
+					d = l
+				}
+				return &impersonatedSource{ctx: ctx, base: base, target: target, scopes: scopes, lifetime: d}
+			}, nil
+		},
+		buildID: func(ctx context.Context, audience string) oauth2.TokenSource {
+			return &iamIDTokenSource{ctx: ctx, base: base, target: target, audience: audience}
+		},
+	}
+}
+
+func (s *scopeSources) get(scopes ...string) (*scopedSource, error) {
+	key := scopeKey(scopes)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if src, ok := s.src[key]; ok {
+		return src, nil
+	}
+	newTS, err := s.build(scopes)
+	if err != nil {
+		return nil, err
+	}
+	src := &scopedSource{
+		scopes: append([]string(nil), scopes...),
+		newTS:  newTS,
+		ts:     oauth2.ReuseTokenSource(nil, newTS(s.ctx)),
+	}
+	s.src[key] = src
+	return src, nil
+}
+
+// idToken returns the cached ID token source for audience.
+func (s *scopeSources) idToken(audience string) (oauth2.TokenSource, error) {
+	if s.buildID == nil {
+		return nil, errors.New("these credentials can't mint ID tokens")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if ts, ok := s.ids[audience]; ok {
+		return ts, nil
+	}
+	if s.ids == nil {
+		s.ids = make(map[string]oauth2.TokenSource)
+	}
+	ts := oauth2.ReuseTokenSource(nil, s.buildID(s.ctx, audience))
+	s.ids[audience] = ts
+	return ts, nil
+}
+
+// scopeKey is the order-independent cache key for a scope set.
+func scopeKey(scopes []string) string {
+	sorted := append([]string(nil), scopes...)
+	sort.Strings(sorted)
+	return strings.Join(sorted, " ")
+}
+
+// requestedScopes collects scopes from repeated and/or space-separated
+// `scope` query params, deduplicated in request order.
+func requestedScopes(vals []string) []string {
+	seen := make(map[string]bool)
+	var out []string
+	for _, v := range vals {
+		for _, sc := range strings.Fields(v) {
+			if !seen[sc] {
+				seen[sc] = true
+				out = append(out, sc)
+			}
+		}
+	}
+	return out
+}
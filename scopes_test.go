@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// testSAJSON is a service account key whose token_uri is tokenURL.
+func testSAJSON(t *testing.T, key *rsa.PrivateKey, tokenURL string) []byte {
+	t.Helper()
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, err := json.Marshal(map[string]string{
+		"type":           "service_account",
+		"client_email":   "broker@project.iam.gserviceaccount.com",
+		"private_key_id": "key-1",
+		"private_key":    string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		"token_uri":      tokenURL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+// scopeEchoEndpoint is a token endpoint that mints "tok-<scope>" for the
+// scope claim of each JWT assertion, recording the claims in asserted.
+func scopeEchoEndpoint(t *testing.T, asserted *[]string) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		parts := strings.Split(r.PostForm.Get("assertion"), ".")
+		var claims struct {
+			Scope string `json:"scope"`
+		}
+		if len(parts) == 3 {
+			payload, _ := base64.RawURLEncoding.DecodeString(parts[1])
+			_ = json.Unmarshal(payload, &claims)
+		}
+		*asserted = append(*asserted, claims.Scope)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"access_token":"tok-` + claims.Scope + `","token_type":"Bearer","expires_in":3600}`))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestScopeSourcesBindRequestedScopes(t *testing.T) {
+	var asserted []string
+	tokenSrv := scopeEchoEndpoint(t, &asserted)
+	sa := testSAJSON(t, newTestSigner(t, "sa").key, tokenSrv.URL)
+	sources := newScopeSources(context.Background(), sa)
+	if _, err := sources.get("scope-a"); err != nil {
+		t.Fatal(err)
+	}
+	src, err := sources.get("scope-b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(src.scopes, []string{"scope-b"}) {
+		t.Errorf("scopes = %q, want [scope-b]", src.scopes)
+	}
+	tok, err := src.Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok.AccessToken != "tok-scope-b" || !slices.Equal(asserted, []string{"scope-b"}) {
+		t.Errorf("minted %q with assertions %q, want scope-b only", tok.AccessToken, asserted)
+	}
+	// asking again returns the cached source
+	if again, _ := sources.get("scope-b"); again != src {
+		t.Error("scope-b source was rebuilt")
+	}
+}
+
+// TestRequestedScopeIsMinted runs a POST /token for scope-b on a broker whose
+// TOKEN_SCOPE is scope-a, all the way to the token endpoint.
+func TestRequestedScopeIsMinted(t *testing.T) {
+	var asserted []string
+	tokenSrv := scopeEchoEndpoint(t, &asserted)
+	sa := testSAJSON(t, newTestSigner(t, "sa").key, tokenSrv.URL)
+	signer := newTestSigner(t, "k1")
+	cfg := testConfig(t, map[string]string{"TOKEN_SCOPE": "scope-a", "ALLOWED_SCOPES": "scope-a,scope-b", "TOKEN_CACHE": "false"})
+	s := newTestServer(t, cfg, newFakeVerifier(signer), &googleMinter{sources: newScopeSources(context.Background(), sa)}, nil)
+
+	for _, tt := range []struct{ body, want string }{
+		{"", "tok-scope-a"},
+		{`{"scopes":["scope-b"]}`, "tok-scope-b"},
+	} {
+		body := tt.body
+		method := http.MethodGet
+		if body != "" {
+			method = http.MethodPost
+		}
+		req := httptest.NewRequest(method, "/token", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+signer.sign(t, idClaims(nil)))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s /token: %d %s", method, rec.Code, rec.Body)
+		}
+		var resp tokenResp
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || resp.AccessToken != tt.want {
+			t.Errorf("%s /token returned %q (%v), want %q", method, resp.AccessToken, err, tt.want)
+		}
+	}
+	if !slices.Equal(asserted, []string{"scope-a", "scope-b"}) {
+		t.Errorf("assertions carried scopes %q, want [scope-a scope-b]", asserted)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ------- additional service accounts -------
+
+// serviceAccountsFile is the JSON shape of SERVICE_ACCOUNTS_FILE. Each
+// account is named (the ?project= value) and may be used by the subjects,
+// emails and domains listed for it, or by anyone when it lists none.
+// Domains maps a caller's hd to the account used when no project is named;
+// callers matching neither mint as GOOGLE_SA_JSON.
+type serviceAccountsFile struct {
+	Accounts map[string]struct {
+		CredentialsFile string   `json:"credentials_file"`
+		Subjects        []string `json:"subjects"`
+		Emails          []string `json:"emails"`
+		Domains         []string `json:"domains"`
+	} `json:"accounts"`
+	Domains map[string]string `json:"domains"`
+}
+
+type serviceAccount struct {
+	name   string
+	email  string // what tokens are minted as
+	minter Minter
+
+	subjects, emails, domains map[string]bool
+}
+
+// serviceAccounts picks the account a verified caller mints as. A nil
+// *serviceAccounts only ever picks the primary.
+type serviceAccounts struct {
+	byName   map[string]*serviceAccount
+	byDomain map[string]*serviceAccount
+	match    emailMatch
+}
+
+var errProjectNotAllowed = errors.New("project not allowed")
+
+// loadServiceAccounts reads SERVICE_ACCOUNTS_FILE and builds a minter per
+// account from its credentials file, which may be any type GOOGLE_SA_JSON
+// accepts. With TOKEN_CACHE each account gets its own cache.
+func loadServiceAccounts(ctx context.Context, cfg Config, out *egress) (*serviceAccounts, error) {
+	path, match := cfg.ServiceAccountsFile, cfg.EmailMatch
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var raw serviceAccountsFile
+	if err := json.Unmarshal(buf, &raw); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	lower := func(s string) string { return strings.ToLower(strings.TrimSpace(s)) }
+	set := func(vals []string, norm func(string) string) map[string]bool {
+		out := make(map[string]bool, len(vals))
+		for _, v := range vals {
+			out[norm(v)] = true
+		}
+		return out
+	}
+	s := &serviceAccounts{byName: make(map[string]*serviceAccount), byDomain: make(map[string]*serviceAccount), match: match}
+	for name, acct := range raw.Accounts {
+		if acct.CredentialsFile == "" {
+			return nil, fmt.Errorf("account %q: credentials_file is required", name)
+		}
+		creds, err := os.ReadFile(acct.CredentialsFile)
+		if err != nil {
+			return nil, fmt.Errorf("account %q: %w", name, err)
+		}
+		if err := checkCredentials(creds); err != nil {
+			return nil, fmt.Errorf("account %q: %s: %w", name, acct.CredentialsFile, err)
+		}
+		var m Minter = &googleMinter{sources: newScopeSources(ctx, creds), out: out}
+		if cfg.TokenCache {
+			m = newCachingMinter(m, cfg.RefreshSkew)
+		}
+		s.byName[name] = &serviceAccount{
+			name:     name,
+			email:    credentialsEmail(creds),
+			minter:   m,
+			subjects: set(acct.Subjects, strings.TrimSpace),
+			emails:   set(acct.Emails, match.normalize),
+			domains:  set(acct.Domains, lower),
+		}
+	}
+	for hd, name := range raw.Domains {
+		acct, ok := s.byName[name]
+		if !ok {
+			return nil, fmt.Errorf("domain %q: unknown account %q", hd, name)
+		}
+		s.byDomain[lower(hd)] = acct
+	}
+	return s, nil
+}
+
+// pick returns the account named by project, which the caller must be
+// allowed to use, or without one the account for the caller's domain. nil
+// means the primary account.
+func (s *serviceAccounts) pick(c whoamiResp, project string) (*serviceAccount, error) {
+	if project == "" {
+		if s == nil {
+			return nil, nil
+		}
+		return s.byDomain[strings.ToLower(c.HD)], nil
+	}
+	if s == nil {
+		return nil, errProjectNotAllowed
+	}
+	acct, ok := s.byName[project]
+	if !ok || !acct.permits(c, s.match) {
+		return nil, errProjectNotAllowed
+	}
+	return acct, nil
+}
+
+func (a *serviceAccount) permits(c whoamiResp, match emailMatch) bool {
+	if len(a.subjects) == 0 && len(a.emails) == 0 && len(a.domains) == 0 {
+		return true
+	}
+	return a.subjects[c.Subject] ||
+		(c.Email != "" && a.emails[match.normalize(c.Email)]) ||
+		(c.HD != "" && a.domains[strings.ToLower(c.HD)])
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestServiceAccounts(t *testing.T) {
+	tokenSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"access_token":"ya29.analytics","token_type":"Bearer","expires_in":3600}`))
+	}))
+	defer tokenSrv.Close()
+
+	dir := t.TempDir()
+	creds := filepath.Join(dir, "analytics.json")
+	if err := os.WriteFile(creds, testSAJSON(t, newTestSigner(t, "sa").key, tokenSrv.URL), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	writeFile := func(name, body string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(body), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	accounts := `"accounts": {
+		"analytics": {"credentials_file": "` + creds + `", "domains": ["example.com"]},
+		"billing": {"credentials_file": "` + creds + `", "subjects": ["someone-else"]}
+	}`
+	byProject := writeFile("by-project.json", `{`+accounts+`}`)
+	byDomain := writeFile("by-domain.json", `{`+accounts+`, "domains": {"EXAMPLE.com": "analytics"}}`)
+
+	signer := newTestSigner(t, "k1")
+	valid := signer.sign(t, idClaims(nil)) // hd example.com
+	tests := []struct {
+		name, file, path string
+		wantStatus       int
+		wantBody         string
+	}{
+		{"primary by default", byProject, "/token", http.StatusOK, `"access_token":"ya29.test"`},
+		{"project", byProject, "/token?project=analytics", http.StatusOK, `"access_token":"ya29.analytics"`},
+		{"project not granted", byProject, "/token?project=billing", http.StatusForbidden, `"code":"project_not_allowed"`},
+		{"unknown project", byProject, "/token?project=nope", http.StatusForbidden, `"code":"project_not_allowed"`},
+		{"domain default", byDomain, "/token", http.StatusOK, `"access_token":"ya29.analytics"`},
+		{"introspect checks the project", byProject, "/token/introspect?project=billing", http.StatusForbidden, `"code":"project_not_allowed"`},
+		{"batch", byProject, "/token/batch?scope=https://www.googleapis.com/auth/cloud-platform&project=analytics", http.StatusOK, `"access_token":"ya29.analytics"`},
+		{"stream checks the project", byProject, "/token/stream?project=billing", http.StatusForbidden, `"code":"project_not_allowed"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, map[string]string{"SERVICE_ACCOUNTS_FILE": tt.file, "ENABLE_TOKEN_STREAM": "true"})
+			s := newTestServer(t, cfg, newFakeVerifier(signer), &fakeMinter{}, nil)
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			req.Header.Set("Authorization", "Bearer "+valid)
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, req)
+			if rec.Code != tt.wantStatus || !strings.Contains(rec.Body.String(), tt.wantBody) {
+				t.Errorf("%s: %d %s, want %d with %s", tt.path, rec.Code, rec.Body, tt.wantStatus, tt.wantBody)
+			}
+		})
+	}
+
+	// a stream mints from the same account /token would use
+	t.Run("stream", func(t *testing.T) {
+		cfg := testConfig(t, map[string]string{"SERVICE_ACCOUNTS_FILE": byDomain, "ENABLE_TOKEN_STREAM": "true"})
+		ts := httptest.NewServer(newTestServer(t, cfg, newFakeVerifier(signer), &fakeMinter{}, nil))
+		defer ts.Close()
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+"/token/stream", nil)
+		req.Header.Set("Authorization", "Bearer "+valid)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		events := bufio.NewScanner(resp.Body)
+		for events.Scan() {
+			if data, ok := strings.CutPrefix(events.Text(), "data: "); ok {
+				if !strings.Contains(data, `"access_token":"ya29.analytics"`) {
+					t.Errorf("first event = %s, want the analytics account's token", data)
+				}
+				return
+			}
+		}
+		t.Fatalf("stream ended without a token: %v", events.Err())
+	})
+
+	bad := writeFile("bad.json", `{`+accounts+`, "domains": {"example.org": "missing"}}`)
+	if _, err := loadServiceAccounts(context.Background(), Config{ServiceAccountsFile: bad}, nil); err == nil || !strings.Contains(err.Error(), "unknown account") {
+		t.Errorf("domain naming an unknown account: err = %v", err)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// ------- token stream (SSE) -------
+
+// streamSlots caps concurrent /token/stream connections per subject.
+type streamSlots struct {
+	mu  sync.Mutex
+	max int
+	n   map[string]int
+}
+
+func newStreamSlots(max int) *streamSlots {
+	return &streamSlots{max: max, n: make(map[string]int)}
+}
+
+func (s *streamSlots) acquire(sub string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.n[sub] >= s.max {
+		return false
+	}
+	s.n[sub]++
+	return true
+}
+
+func (s *streamSlots) release(sub string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.n[sub]--; s.n[sub] <= 0 {
+		delete(s.n, sub)
+	}
+}
+
+// writeEvent sends one SSE event with a JSON payload and flushes it.
+func writeEvent(w http.ResponseWriter, f http.Flusher, rc responseCase, event string, v any) error {
+	data, err := rc.marshal(v)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data); err != nil {
+		return err
+	}
+	f.Flush()
+	return nil
+}
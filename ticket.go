@@ -0,0 +1,60 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"time"
+)
+
+// ------- broker tickets -------
+
+// Tickets let internal services trust "the broker verified this identity at
+// iat" without calling Google: a compact HS256 JWT signed with the shared
+// TICKET_SIGNING_KEY. golang.org/x/oauth2/jws only signs RS256, so the
+// encoding is done here.
+
+// minTicketKeyLen is the shortest TICKET_SIGNING_KEY accepted; RFC 7518
+// wants an HS256 key at least as long as the hash.
+const minTicketKeyLen = 32
+
+type ticketClaims struct {
+	Issuer   string `json:"iss"`
+	Subject  string `json:"sub"`
+	Email    string `json:"email,omitempty"`
+	IssuedAt int64  `json:"iat"`
+	Expiry   int64  `json:"exp"`
+}
+
+type ticketResp struct {
+	Ticket    string `json:"ticket"`
+	TokenType string `json:"token_type"`
+	ExpiresIn int    `json:"expires_in"`
+}
+
+// ticketHeader is the fixed, pre-encoded JOSE header.
+var ticketHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+func signTicket(key []byte, c ticketClaims) (string, error) {
+	payload, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	signed := ticketHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// newTicket issues a ticket for claims lasting ttl, but never past the ID
+// token it was verified from.
+func newTicket(key []byte, issuer string, claims whoamiResp, ttl time.Duration, now time.Time) (string, ticketClaims, error) {
+	exp := now.Add(ttl).Unix()
+	if claims.Exp > 0 && claims.Exp < exp {
+		exp = claims.Exp
+	}
+	c := ticketClaims{Issuer: issuer, Subject: claims.Subject, Email: claims.Email, IssuedAt: now.Unix(), Expiry: exp}
+	raw, err := signTicket(key, c)
+	return raw, c, err
+}
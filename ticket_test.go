@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testTicketKey = "0123456789abcdef0123456789abcdef"
+
+// checkTicket verifies raw the way an internal service would and returns
+// its claims.
+func checkTicket(t *testing.T, key, raw string) ticketClaims {
+	t.Helper()
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		t.Fatalf("ticket %q is not a JWT", raw)
+	}
+	header, _ := base64.RawURLEncoding.DecodeString(parts[0])
+	if string(header) != `{"alg":"HS256","typ":"JWT"}` {
+		t.Errorf("header = %s", header)
+	}
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if sig, _ := base64.RawURLEncoding.DecodeString(parts[2]); !hmac.Equal(sig, mac.Sum(nil)) {
+		t.Fatal("ticket signature doesn't verify")
+	}
+	payload, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	var c ticketClaims
+	if err := json.Unmarshal(payload, &c); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestTicketEndpoint(t *testing.T) {
+	signer := newTestSigner(t, "k1")
+	s := newTestServer(t, testConfig(t, map[string]string{
+		"TICKET_SIGNING_KEY": testTicketKey,
+		"TICKET_ISSUER":      "https://broker.internal",
+		"TICKET_TTL":         "2m",
+		"ALLOWED_HD":         "example.com",
+	}), newFakeVerifier(signer), &fakeMinter{}, nil)
+	get := func(claims map[string]any) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/ticket", nil)
+		req.Header.Set("Authorization", "Bearer "+signer.sign(t, idClaims(claims)))
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for _, tt := range []struct {
+		name    string
+		claims  map[string]any
+		wantTTL int64
+	}{
+		{"ttl", nil, 120},
+		{"capped at id token exp", map[string]any{"exp": time.Now().Add(time.Minute).Unix()}, 60},
+	} {
+		rec := get(tt.claims)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: %d %s", tt.name, rec.Code, rec.Body)
+		}
+		var resp ticketResp
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		c := checkTicket(t, testTicketKey, resp.Ticket)
+		if c.Issuer != "https://broker.internal" || c.Subject != "user-1" || c.Email != "user@example.com" {
+			t.Errorf("%s: claims %+v", tt.name, c)
+		}
+		if ttl := c.Expiry - c.IssuedAt; ttl < tt.wantTTL-1 || ttl > tt.wantTTL || int64(resp.ExpiresIn) != ttl {
+			t.Errorf("%s: ticket lasts %ds (expires_in %d), want %d", tt.name, ttl, resp.ExpiresIn, tt.wantTTL)
+		}
+	}
+
+	if rec := get(map[string]any{"hd": "example.org"}); rec.Code != http.StatusForbidden {
+		t.Errorf("wrong domain: %d %s, want 403", rec.Code, rec.Body)
+	}
+}
+
+func TestTicketTokenAudience(t *testing.T) {
+	signer := newTestSigner(t, "k1")
+	s := newTestServer(t, testConfig(t, map[string]string{
+		"TICKET_SIGNING_KEY": testTicketKey,
+		"OIDC_CLIENT_ID":     testClientID + ",privileged.apps.googleusercontent.com",
+		"TOKEN_AUDIENCE":     "privileged.apps.googleusercontent.com",
+	}), newFakeVerifier(signer), &fakeMinter{}, nil)
+	req := httptest.NewRequest(http.MethodGet, "/ticket", nil)
+	req.Header.Set("Authorization", "Bearer "+signer.sign(t, idClaims(nil))) // aud: testClientID
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), `"code":"audience_not_allowed"`) {
+		t.Errorf("ticket for a token outside TOKEN_AUDIENCE: %d %s, want 403 audience_not_allowed", rec.Code, rec.Body)
+	}
+}
+
+func TestTicketConfig(t *testing.T) {
+	signer := newTestSigner(t, "k1")
+	s := newTestServer(t, testConfig(t, map[string]string{"TICKET_SIGNING_KEY": ""}), newFakeVerifier(signer), &fakeMinter{}, nil)
+	req := httptest.NewRequest(http.MethodGet, "/ticket", nil)
+	req.Header.Set("Authorization", "Bearer "+signer.sign(t, idClaims(nil)))
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("without TICKET_SIGNING_KEY: %d, want 404", rec.Code)
+	}
+
+	for _, env := range []map[string]string{
+		{"TICKET_SIGNING_KEY": "too-short"},
+		{"TICKET_SIGNING_KEY": testTicketKey, "TICKET_TTL": "2h"},
+	} {
+		setTestEnv(t, env)
+		if _, err := loadConfig(); err == nil {
+			t.Errorf("%v accepted", env)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+)
+
+// ------- direct TLS -------
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func parseTLSVersion(v string) (uint16, error) {
+	if ver, ok := tlsVersions[v]; ok {
+		return ver, nil
+	}
+	return 0, fmt.Errorf("unknown TLS version %q (want 1.0, 1.1, 1.2 or 1.3)", v)
+}
+
+// newTLSConfig enforces min on inbound handshakes. crypto/tls already refuses
+// clients below MinVersion; the hook only logs who tried, with the highest
+// version they offered, so downgrade attempts are visible. HTTP/2 is offered
+// ahead of HTTP/1.1.
+func newTLSConfig(min uint16) *tls.Config {
+	base := &tls.Config{MinVersion: min, NextProtos: []string{"h2", "http/1.1"}}
+	base.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		offered := uint16(0)
+		for _, v := range hello.SupportedVersions {
+			offered = max(offered, v)
+		}
+		if offered < min {
+			log.Printf("tls handshake rejected: remote=%s offered=%s min=%s",
+				hello.Conn.RemoteAddr(), tls.VersionName(offered), tls.VersionName(min))
+		}
+		return nil, nil
+	}
+	return base
+}
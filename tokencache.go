@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// ------- minted token cache -------
+
+// cachingMinter reuses a minted token per scope set (and requested
+// lifetime) until it is within skew of expiry, and lets only one caller per
+// scope set mint at a time; the rest wait for its result. It is only
+// correct for minters whose tokens don't depend on the caller, such as the
+// Google SA minter.
+type cachingMinter struct {
+	next Minter
+	skew time.Duration
+
+	mu       sync.Mutex
+	toks     map[string]*oauth2.Token
+	inflight map[string]*mintCall
+}
+
+// mintCall is one in-progress mint that other callers can wait on.
+type mintCall struct {
+	done chan struct{}
+	tok  *oauth2.Token
+	err  error
+}
+
+func newCachingMinter(next Minter, skew time.Duration) *cachingMinter {
+	return &cachingMinter{
+		next:     next,
+		skew:     skew,
+		toks:     make(map[string]*oauth2.Token),
+		inflight: make(map[string]*mintCall),
+	}
+}
+
+func (m *cachingMinter) Mint(ctx context.Context, claims whoamiResp, scopes []string) (*oauth2.Token, error) {
+	key := scopeKey(scopes)
+	if l := lifetimeFrom(ctx); l > 0 {
+		key += "|" + l.String()
+	}
+	m.mu.Lock()
+	if tok, ok := m.toks[key]; ok && time.Until(tok.Expiry) > m.skew {
+		m.mu.Unlock()
+		return tok, nil
+	}
+	if call, ok := m.inflight[key]; ok {
+		m.mu.Unlock()
+		select {
+		case <-call.done:
+			return call.tok, call.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	call := &mintCall{done: make(chan struct{})}
+	m.inflight[key] = call
+	m.mu.Unlock()
+
+	call.tok, call.err = m.next.Mint(ctx, claims, scopes)
+
+	m.mu.Lock()
+	delete(m.inflight, key)
+	if call.err == nil && !call.tok.Expiry.IsZero() {
+		m.toks[key] = call.tok
+	}
+	m.mu.Unlock()
+	close(call.done)
+	return call.tok, call.err
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// gatedMinter blocks every mint until release is closed.
+type gatedMinter struct {
+	calls   atomic.Int32
+	release chan struct{}
+	expiry  time.Duration
+}
+
+func (m *gatedMinter) Mint(context.Context, whoamiResp, []string) (*oauth2.Token, error) {
+	m.calls.Add(1)
+	<-m.release
+	return &oauth2.Token{AccessToken: "tok", Expiry: time.Now().Add(m.expiry)}, nil
+}
+
+func TestCachingMinterSingleFlight(t *testing.T) {
+	next := &gatedMinter{release: make(chan struct{}), expiry: time.Hour}
+	m := newCachingMinter(next, 2*time.Minute)
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if tok, err := m.Mint(context.Background(), whoamiResp{}, []string{"a", "b"}); err != nil || tok.AccessToken != "tok" {
+				t.Errorf("Mint = %v, %v", tok, err)
+			}
+		}()
+	}
+	// let the callers pile up behind the first mint
+	for deadline := time.Now().Add(time.Second); next.calls.Load() == 0 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(next.release)
+	wg.Wait()
+	if got := next.calls.Load(); got != 1 {
+		t.Errorf("upstream mints = %d, want 1", got)
+	}
+
+	// scope order doesn't matter; a cached token is reused
+	if _, err := m.Mint(context.Background(), whoamiResp{}, []string{"b", "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := next.calls.Load(); got != 1 {
+		t.Errorf("upstream mints after cache hit = %d, want 1", got)
+	}
+}
+
+func TestCachingMinterRefreshesNearExpiry(t *testing.T) {
+	next := &gatedMinter{release: make(chan struct{}), expiry: time.Minute}
+	close(next.release)
+	m := newCachingMinter(next, 2*time.Minute)
+	for i := 0; i < 3; i++ {
+		if _, err := m.Mint(context.Background(), whoamiResp{}, []string{"a"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := next.calls.Load(); got != 3 {
+		t.Errorf("upstream mints = %d, want 3 (tokens inside the skew are never reused)", got)
+	}
+}
+
+func TestCachingMinterKeysByLifetime(t *testing.T) {
+	next := &gatedMinter{release: make(chan struct{}), expiry: time.Hour}
+	close(next.release)
+	m := newCachingMinter(next, 2*time.Minute)
+	ctx := context.Background()
+	for _, c := range []context.Context{ctx, withLifetime(ctx, 10*time.Minute), ctx} {
+		if _, err := m.Mint(c, whoamiResp{}, []string{"a"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := next.calls.Load(); got != 2 {
+		t.Errorf("upstream mints = %d, want 2", got)
+	}
+}
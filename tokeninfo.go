@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+const googleTokeninfoURL = "https://oauth2.googleapis.com/tokeninfo"
+
+// ------- effective scopes -------
+
+// mintedScopes is the space-separated scope list a token was minted with.
+// Minters record it as the token's "scope" extra; a token without one falls
+// back to what was requested.
+func mintedScopes(tok *oauth2.Token, requested []string) string {
+	if s, ok := tok.Extra("scope").(string); ok && s != "" {
+		return s
+	}
+	return strings.Join(requested, " ")
+}
+
+// droppedScopes lists the requested scopes missing from granted, in request
+// order.
+func droppedScopes(requested []string, granted string) []string {
+	have := strings.Fields(granted)
+	var dropped []string
+	for _, sc := range requested {
+		if !slices.Contains(have, sc) {
+			dropped = append(dropped, sc)
+		}
+	}
+	return dropped
+}
+
+// tokeninfoScopes asks Google which scopes an access token carries. It costs
+// an upstream call, so it only runs for ?verify=1.
+func tokeninfoScopes(ctx context.Context, accessToken string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, googleTokeninfoURL, strings.NewReader(url.Values{"access_token": {accessToken}}.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := clientFrom(ctx).Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("tokeninfo status %d", resp.StatusCode)
+	}
+	var info struct {
+		Scope string `json:"scope"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return "", err
+	}
+	return info.Scope, nil
+}
+
+// sameScopes compares two space-separated scope lists as sets.
+func sameScopes(a, b string) bool {
+	x, y := strings.Fields(a), strings.Fields(b)
+	slices.Sort(x)
+	slices.Sort(y)
+	return slices.Equal(slices.Compact(x), slices.Compact(y))
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestSameScopes(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"a b", "b a", true},
+		{"a  b", "a b b", true},
+		{"a", "a b", false},
+		{"", "", true},
+		{"a", "", false},
+	}
+	for _, tt := range tests {
+		if got := sameScopes(tt.a, tt.b); got != tt.want {
+			t.Errorf("sameScopes(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestDroppedScopes(t *testing.T) {
+	got := droppedScopes([]string{"a", "b", "c"}, "c a")
+	if !slices.Equal(got, []string{"b"}) {
+		t.Errorf("droppedScopes = %q, want [b]", got)
+	}
+	if got := droppedScopes([]string{"a"}, "a b"); len(got) != 0 {
+		t.Errorf("droppedScopes = %q, want none", got)
+	}
+}
+
+// rewriteTransport sends every request to target, keeping the path.
+type rewriteTransport struct{ target *url.URL }
+
+func (rt rewriteTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	r.URL.Scheme, r.URL.Host = rt.target.Scheme, rt.target.Host
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+const cloudPlatformScope = "https://www.googleapis.com/auth/cloud-platform"
+
+func TestTokenVerifyAgainstTokeninfo(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		info     string
+		verified bool
+	}{
+		{"same scopes", cloudPlatformScope, true},
+		{"different scopes", "openid", false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			tokeninfo := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_ = json.NewEncoder(w).Encode(map[string]string{"scope": tt.info})
+			}))
+			defer tokeninfo.Close()
+			target, _ := url.Parse(tokeninfo.URL)
+			out := &egress{client: &http.Client{Transport: rewriteTransport{target}}}
+
+			signer := newTestSigner(t, "k1")
+			s := newTestServer(t, testConfig(t, nil), newFakeVerifier(signer), &fakeMinter{}, out)
+
+			req := httptest.NewRequest(http.MethodGet, "/token?verify=1", nil)
+			req.Header.Set("Authorization", "Bearer "+signer.sign(t, idClaims(nil)))
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, req)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d; body %q", rec.Code, rec.Body)
+			}
+			var resp tokenResp
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.ScopeVerified == nil || *resp.ScopeVerified != tt.verified {
+				t.Errorf("scope_verified = %v, want %v", resp.ScopeVerified, tt.verified)
+			}
+		})
+	}
+}
+
+// TestMintedScopesMatchTokeninfo mints through a real JWT config and checks
+// that the scope reported in the response and the audit record is the one
+// the assertion carried, and that ?verify=1 agrees with tokeninfo.
+func TestMintedScopesMatchTokeninfo(t *testing.T) {
+	var asserted []string
+	tokenSrv := scopeEchoEndpoint(t, &asserted)
+	// tokeninfo reports the scope scopeEchoEndpoint minted "tok-<scope>" for
+	tokeninfo := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		_ = json.NewEncoder(w).Encode(map[string]string{"scope": strings.TrimPrefix(r.PostForm.Get("access_token"), "tok-")})
+	}))
+	defer tokeninfo.Close()
+	target, _ := url.Parse(tokeninfo.URL)
+	out := &egress{client: &http.Client{Transport: googleOnlyTransport{rewriteTransport{target}}}}
+
+	auditPath := filepath.Join(t.TempDir(), "audit.log")
+	sa := testSAJSON(t, newTestSigner(t, "sa").key, tokenSrv.URL)
+	signer := newTestSigner(t, "k1")
+	cfg := testConfig(t, map[string]string{"TOKEN_SCOPE": "scope-a", "ALLOWED_SCOPES": "scope-a", "TOKEN_CACHE": "false", "AUDIT_LOG_FILE": auditPath})
+	s := newTestServer(t, cfg, newFakeVerifier(signer), &googleMinter{sources: newScopeSources(context.Background(), sa)}, out)
+
+	req := httptest.NewRequest(http.MethodGet, "/token?verify=1", nil)
+	req.Header.Set("Authorization", "Bearer "+signer.sign(t, idClaims(nil)))
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d; body %q", rec.Code, rec.Body)
+	}
+	var resp tokenResp
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Scope != "scope-a" || !slices.Equal(asserted, []string{"scope-a"}) {
+		t.Errorf("response scope %q, assertions %q; want scope-a", resp.Scope, asserted)
+	}
+	if resp.ScopeVerified == nil || !*resp.ScopeVerified {
+		t.Errorf("scope_verified = %v, want true", resp.ScopeVerified)
+	}
+
+	s.close() // flushes the audit log
+	buf, err := os.ReadFile(auditPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rec0 auditRecord
+	if err := json.Unmarshal(bytes.TrimSpace(buf), &rec0); err != nil {
+		t.Fatalf("audit %q: %v", buf, err)
+	}
+	if rec0.Scope != resp.Scope {
+		t.Errorf("audit scope %q, response scope %q", rec0.Scope, resp.Scope)
+	}
+}
+
+// googleOnlyTransport sends Google API calls through rewriteTransport and
+// everything else, such as a test token endpoint, straight through.
+type googleOnlyTransport struct{ rewriteTransport }
+
+func (rt googleOnlyTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if strings.HasSuffix(r.URL.Host, "googleapis.com") {
+		return rt.rewriteTransport.RoundTrip(r)
+	}
+	return http.DefaultTransport.RoundTrip(r)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	defaultTraceTTL = 10 * time.Minute
+	maxTraceTTL     = time.Hour
+)
+
+// ------- per-user debug tracing -------
+type traceRegistry struct {
+	mu     sync.Mutex
+	keys   map[string]time.Time // "sub:<sub>" or "email:<email>" → expiry
+	emails emailMatch
+}
+
+func newTraceRegistry(emails emailMatch) *traceRegistry {
+	return &traceRegistry{keys: make(map[string]time.Time), emails: emails}
+}
+
+func (t *traceRegistry) emailKey(email string) string {
+	return "email:" + t.emails.normalize(email)
+}
+
+func (t *traceRegistry) enable(key string, ttl time.Duration) time.Time {
+	exp := time.Now().Add(ttl)
+	t.mu.Lock()
+	t.keys[key] = exp
+	t.mu.Unlock()
+	log.Printf("trace enabled for %s until %s", key, exp.UTC().Format(time.RFC3339))
+	return exp
+}
+
+func (t *traceRegistry) disable(key string) {
+	t.mu.Lock()
+	delete(t.keys, key)
+	t.mu.Unlock()
+	log.Printf("trace disabled for %s", key)
+}
+
+func (t *traceRegistry) active(sub, email string) bool {
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, key := range []string{"sub:" + sub, t.emailKey(email)} {
+		exp, ok := t.keys[key]
+		if !ok {
+			continue
+		}
+		if now.After(exp) {
+			delete(t.keys, key)
+			log.Printf("trace expired for %s", key)
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// begin returns a request trace when sub or email is being traced, nil otherwise.
+func (t *traceRegistry) begin(route, sub, email string, start time.Time) *reqTrace {
+	if !t.active(sub, email) {
+		return nil
+	}
+	return &reqTrace{route: route, sub: sub, start: start}
+}
+
+// reqTrace writes verbose decision logs for one request. A nil *reqTrace is a no-op.
+type reqTrace struct {
+	route string
+	sub   string
+	start time.Time
+}
+
+func (rt *reqTrace) logf(format string, args ...any) {
+	if rt == nil {
+		return
+	}
+	log.Printf("trace %s sub=%s +%s: %s", rt.route, rt.sub, time.Since(rt.start).Round(time.Microsecond), fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/oauth2"
+)
+
+// ------- OpenTelemetry tracing -------
+
+// Tracing is on only with OTEL_EXPORTER_OTLP_ENDPOINT. Otherwise nothing is
+// wrapped and no span is ever started, so it costs nothing by default.
+
+const tracerName = "github.com/NoiseMeldOrg/rapture-tokenbroker"
+
+var attrSubject = attribute.Key("enduser.id")
+
+// setupTracing installs an OTLP/HTTP exporter as the global tracer provider
+// and W3C trace-context propagation. The exporter reads the standard
+// OTEL_EXPORTER_OTLP_* variables itself (endpoint, headers, timeout), and
+// OTEL_SERVICE_NAME overrides the service name.
+func setupTracing(ctx context.Context) (shutdown func(context.Context) error, err error) {
+	exp, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res, err := resource.New(ctx,
+		resource.WithAttributes(attribute.String("service.name", "rapture-tokenbroker")),
+		resource.WithFromEnv())
+	if err != nil {
+		return nil, err
+	}
+	tp := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exp), sdktrace.WithResource(res))
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return tp.Shutdown, nil
+}
+
+// startRequestSpan starts the server span for r, continuing the caller's
+// trace when it sent a traceparent header. end finishes it with the
+// response status.
+func startRequestSpan(r *http.Request, route string) (_ *http.Request, end func(status int)) {
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := otel.Tracer(tracerName).Start(ctx, r.Method+" "+route,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("http.request.method", r.Method),
+			attribute.String("http.route", route),
+		))
+	return r.WithContext(ctx), func(status int) {
+		span.SetAttributes(attribute.Int("http.response.status_code", status))
+		if status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+		span.End()
+	}
+}
+
+func recordSpanError(span trace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
+
+// tracedVerifier adds an "oidc.verify" span around each verification and
+// records the verified subject on it and on the request span.
+type tracedVerifier struct{ TokenVerifier }
+
+func (v tracedVerifier) Verify(ctx context.Context, raw string) (*oidc.IDToken, error) {
+	return traceVerify(ctx, raw, v.TokenVerifier.Verify)
+}
+
+func (v tracedVerifier) VerifyAnyAudience(ctx context.Context, raw string) (*oidc.IDToken, error) {
+	return traceVerify(ctx, raw, v.TokenVerifier.VerifyAnyAudience)
+}
+
+func traceVerify(ctx context.Context, raw string, verify func(context.Context, string) (*oidc.IDToken, error)) (*oidc.IDToken, error) {
+	parent := trace.SpanFromContext(ctx)
+	ctx, span := otel.Tracer(tracerName).Start(ctx, "oidc.verify")
+	defer span.End()
+	tok, err := verify(ctx, raw)
+	if err != nil {
+		recordSpanError(span, err)
+		return nil, err
+	}
+	span.SetAttributes(attrSubject.String(tok.Subject), attribute.String("oidc.issuer", tok.Issuer))
+	parent.SetAttributes(attrSubject.String(tok.Subject))
+	return tok, nil
+}
+
+// tracedMinter adds a "token.mint" span around each mint.
+type tracedMinter struct{ Minter }
+
+func (m tracedMinter) Mint(ctx context.Context, claims whoamiResp, scopes []string) (*oauth2.Token, error) {
+	ctx, span := otel.Tracer(tracerName).Start(ctx, "token.mint", trace.WithAttributes(
+		attrSubject.String(claims.Subject),
+		attribute.StringSlice("token.scopes", scopes),
+	))
+	defer span.End()
+	tok, err := m.Minter.Mint(ctx, claims, scopes)
+	if err != nil {
+		recordSpanError(span, err)
+	}
+	return tok, err
+}
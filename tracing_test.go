@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTracingSpans(t *testing.T) {
+	rec := tracetest.NewSpanRecorder()
+	prevTP, prevProp := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() { otel.SetTracerProvider(prevTP); otel.SetTextMapPropagator(prevProp) })
+
+	signer := newTestSigner(t, "k1")
+	minter := &flakyMinter{}
+	cfg := testConfig(t, map[string]string{"OTEL_EXPORTER_OTLP_ENDPOINT": "http://collector:4318"})
+	s := newTestServer(t, cfg, newFakeVerifier(signer), minter, nil)
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	get := func() {
+		req := httptest.NewRequest(http.MethodGet, "/token", nil)
+		req.Header.Set("Authorization", "Bearer "+signer.sign(t, idClaims(nil)))
+		req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+		s.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	get()
+	spans := make(map[string]sdktrace.ReadOnlySpan)
+	for _, sp := range rec.Ended() {
+		spans[sp.Name()] = sp
+		if got := sp.SpanContext().TraceID().String(); got != traceID {
+			t.Errorf("%s: trace id %s, want the caller's %s", sp.Name(), got, traceID)
+		}
+	}
+	for _, name := range []string{"GET /token", "oidc.verify", "token.mint"} {
+		if spans[name] == nil {
+			t.Fatalf("no %q span; got %v", name, spans)
+		}
+	}
+	for _, name := range []string{"GET /token", "oidc.verify", "token.mint"} {
+		var sub string
+		for _, kv := range spans[name].Attributes() {
+			if kv.Key == attrSubject {
+				sub = kv.Value.AsString()
+			}
+		}
+		if sub != "user-1" {
+			t.Errorf("%s: enduser.id = %q, want user-1", name, sub)
+		}
+	}
+	if p := spans["token.mint"].Parent(); p.SpanID() != spans["GET /token"].SpanContext().SpanID() {
+		t.Error("token.mint isn't a child of the request span")
+	}
+
+	minter.fail.Store(true)
+	get()
+	ended := rec.Ended()
+	if mint := ended[len(ended)-2]; mint.Name() != "token.mint" || mint.Status().Code != codes.Error || len(mint.Events()) == 0 {
+		t.Errorf("failed mint span = %s, status %v, %d events; want an error recorded", mint.Name(), mint.Status(), len(mint.Events()))
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"sync"
+)
+
+// ------- issued token lifetimes -------
+
+// ttlStats summarizes the expires_in of issued tokens since startup, for
+// /admin/status. The full distribution is tokenbroker_token_ttl_seconds.
+type ttlStats struct {
+	mu       sync.Mutex
+	n        int64
+	sum, min int
+}
+
+func (s *ttlStats) record(ttl int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.n == 0 || ttl < s.min {
+		s.min = ttl
+	}
+	s.n++
+	s.sum += ttl
+}
+
+type ttlSummary struct {
+	Issued int64   `json:"issued"`
+	Min    int     `json:"min_expires_in"`
+	Avg    float64 `json:"avg_expires_in"`
+}
+
+func (s *ttlStats) summary() ttlSummary {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.n == 0 {
+		return ttlSummary{}
+	}
+	return ttlSummary{Issued: s.n, Min: s.min, Avg: float64(s.sum) / float64(s.n)}
+}
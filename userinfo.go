@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2/google"
+)
+
+const googleUserinfoURL = "https://openidconnect.googleapis.com/v1/userinfo"
+
+var userinfoScopes = []string{
+	"openid",
+	"https://www.googleapis.com/auth/userinfo.email",
+	"https://www.googleapis.com/auth/userinfo.profile",
+}
+
+// maxUserinfoCache bounds the per-sub cache; when full, expired entries are
+// swept and, failing that, the cache is reset.
+const maxUserinfoCache = 10000
+
+// ------- userinfo proxy -------
+
+type userinfoEntry struct {
+	body []byte
+	exp  time.Time
+}
+
+// userinfoProxy fetches a user's Google profile by minting a token that
+// impersonates them via domain-wide delegation, so it only works for
+// Workspace users in a domain that granted the SA the userinfo scopes.
+type userinfoProxy struct {
+	saJSON []byte
+	out    *egress
+	ttl    time.Duration
+	mu     sync.Mutex
+	cache  map[string]userinfoEntry
+}
+
+func newUserinfoProxy(saJSON []byte, out *egress, ttl time.Duration) *userinfoProxy {
+	return &userinfoProxy{saJSON: saJSON, out: out, ttl: ttl, cache: make(map[string]userinfoEntry)}
+}
+
+func (u *userinfoProxy) fetch(ctx context.Context, sub, email string) ([]byte, error) {
+	now := time.Now()
+	u.mu.Lock()
+	if e, ok := u.cache[sub]; ok && now.Before(e.exp) {
+		u.mu.Unlock()
+		return e.body, nil
+	}
+	u.mu.Unlock()
+
+	conf, err := google.JWTConfigFromJSON(u.saJSON, userinfoScopes...)
+	if err != nil {
+		return nil, err
+	}
+	conf.Subject = email
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, googleUserinfoURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := conf.Client(u.out.ctx(ctx)).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("userinfo status %d", resp.StatusCode)
+	}
+
+	u.mu.Lock()
+	if len(u.cache) >= maxUserinfoCache {
+		for k, e := range u.cache {
+			if now.After(e.exp) {
+				delete(u.cache, k)
+			}
+		}
+		if len(u.cache) >= maxUserinfoCache {
+			u.cache = make(map[string]userinfoEntry)
+		}
+	}
+	u.cache[sub] = userinfoEntry{body: body, exp: now.Add(u.ttl)}
+	u.mu.Unlock()
+	return body, nil
+}
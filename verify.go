@@ -0,0 +1,385 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+)
+
+const googleIssuer = "https://accounts.google.com"
+
+var (
+	errUnknownIssuer   = errors.New("unknown issuer")
+	errWrongAudience   = errors.New("audience not accepted")
+	errRouteAudience   = errors.New("audience not accepted on this route")
+	errTokenExpired    = errors.New("token expired")
+	errTokenNotYetUsed = errors.New("token not yet valid")
+)
+
+// ------- multi-issuer verification -------
+
+// providerConfig is one entry of OIDC_PROVIDERS.
+type providerConfig struct {
+	Issuer    string   `json:"issuer"`
+	ClientIDs []string `json:"client_ids"`
+}
+
+// normalizeAudiences trims and dedupes a provider's client ids, rejecting
+// empty entries and lists longer than max.
+func normalizeAudiences(ids []string, max int) ([]string, error) {
+	seen := make(map[string]bool, len(ids))
+	out := make([]string, 0, len(ids))
+	for i, id := range ids {
+		id = strings.TrimSpace(id)
+		if id == "" {
+			return nil, fmt.Errorf("client id %d is empty", i+1)
+		}
+		if !seen[id] {
+			seen[id] = true
+			out = append(out, id)
+		}
+	}
+	if len(out) == 0 {
+		return nil, errors.New("at least one client id is required")
+	}
+	if len(out) > max {
+		return nil, fmt.Errorf("%d client ids exceeds MAX_AUDIENCES=%d", len(out), max)
+	}
+	return out, nil
+}
+
+// googleClientIDSuffix is the shape of every Google OAuth client id.
+const googleClientIDSuffix = ".apps.googleusercontent.com"
+
+// warnImplausibleClientIDs logs a prominent warning for Google audiences that
+// don't look like Google client ids (often the client secret pasted by
+// mistake), which would otherwise surface only as 401s on every request.
+// It never fails: other IdPs use other shapes.
+func warnImplausibleClientIDs(providers []providerConfig) {
+	for _, pc := range providers {
+		if normalizeIssuer(pc.Issuer) != normalizeIssuer(googleIssuer) {
+			continue
+		}
+		for _, id := range pc.ClientIDs {
+			if strings.HasSuffix(id, googleClientIDSuffix) {
+				continue
+			}
+			hint := ""
+			if strings.HasPrefix(id, "GOCSPX-") {
+				hint = " (this looks like a client secret)"
+			}
+			log.Printf("WARNING: OIDC client id %.8q… does not end in %s%s; Google ID tokens will fail audience validation", id, googleClientIDSuffix, hint)
+		}
+	}
+}
+
+// issuerEntry is one provider's verifier. The discovery-derived parts can be
+// rebuilt in place (refresh) when keys rotate.
+type issuerEntry struct {
+	issuer    string
+	clientIDs []string
+
+	mu          sync.RWMutex
+	verifier    *oidc.IDTokenVerifier
+	keySet      *oidc.RemoteKeySet
+	jwksURL     string
+	lastRefresh time.Time
+}
+
+// minForcedRefresh spaces out signature-miss refreshes so tokens with bogus
+// key ids can't make the broker hammer the IdP.
+const minForcedRefresh = 30 * time.Second
+
+func (e *issuerEntry) current() (*oidc.IDTokenVerifier, *oidc.RemoteKeySet, string) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.verifier, e.keySet, e.jwksURL
+}
+
+// refresh re-runs discovery and replaces the key set, dropping any cached
+// keys. forced refreshes are skipped within minForcedRefresh of the last.
+func (e *issuerEntry) refresh(ctx context.Context, forced bool) error {
+	e.mu.Lock()
+	if forced && time.Since(e.lastRefresh) < minForcedRefresh {
+		e.mu.Unlock()
+		return nil
+	}
+	e.lastRefresh = time.Now()
+	e.mu.Unlock()
+
+	// discover without the lock so verification isn't stalled meanwhile
+	provider, err := oidc.NewProvider(ctx, e.issuer)
+	if err != nil {
+		return fmt.Errorf("oidc.NewProvider(%s): %w", e.issuer, err)
+	}
+	var meta struct {
+		JWKSURL string   `json:"jwks_uri"`
+		Algs    []string `json:"id_token_signing_alg_values_supported"`
+	}
+	if err := provider.Claims(&meta); err != nil {
+		return fmt.Errorf("oidc discovery (%s): %w", e.issuer, err)
+	}
+	// own the key set so it can be warmed; audience is checked against
+	// the whole client list after verification
+	keySet := oidc.NewRemoteKeySet(ctx, meta.JWKSURL)
+	verifier := oidc.NewVerifier(e.issuer, keySet, &oidc.Config{
+		SkipClientIDCheck:    true,
+		SkipExpiryCheck:      true,
+		SupportedSigningAlgs: meta.Algs,
+	})
+	e.mu.Lock()
+	e.verifier, e.keySet, e.jwksURL = verifier, keySet, meta.JWKSURL
+	e.mu.Unlock()
+	return nil
+}
+
+// issuerVerifier routes each token to the verifier for its (unverified) iss
+// claim; the selected verifier then checks signature and issuer. Time claims
+// (exp, nbf, iat) are checked here with a symmetric clock skew, because
+// go-oidc allows no leeway on exp and a fixed 5m on nbf.
+type issuerVerifier struct {
+	ctx      context.Context // discovery and key fetches
+	byIssuer map[string]*issuerEntry
+	skew     time.Duration
+	cache    *verifyCache // VERIFY_CACHE_SIZE; nil when off
+}
+
+func newIssuerVerifier(ctx context.Context, providers []providerConfig, skew time.Duration) (*issuerVerifier, error) {
+	v := &issuerVerifier{ctx: ctx, byIssuer: make(map[string]*issuerEntry), skew: skew}
+	for _, pc := range providers {
+		if pc.Issuer == "" || len(pc.ClientIDs) == 0 {
+			return nil, fmt.Errorf("provider %q needs an issuer and at least one client id", pc.Issuer)
+		}
+		if _, dup := v.byIssuer[normalizeIssuer(pc.Issuer)]; dup {
+			return nil, fmt.Errorf("issuer %q configured twice", pc.Issuer)
+		}
+		entry := &issuerEntry{issuer: pc.Issuer, clientIDs: pc.ClientIDs}
+		if err := entry.refresh(ctx, false); err != nil {
+			return nil, err
+		}
+		v.byIssuer[normalizeIssuer(pc.Issuer)] = entry
+	}
+	return v, nil
+}
+
+// refreshLoop rebuilds every provider's verifier each interval, so a
+// long-lived process picks up rotated keys and moved JWKS endpoints even if
+// no kid miss triggers it.
+func (v *issuerVerifier) refreshLoop(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			for iss, entry := range v.byIssuer {
+				if err := entry.refresh(v.ctx, false); err != nil {
+					log.Printf("keyset refresh %s: %v; keeping previous keys", iss, err)
+				}
+			}
+		}
+	}
+}
+
+func (v *issuerVerifier) Verify(ctx context.Context, raw string) (*oidc.IDToken, error) {
+	return v.verify(ctx, raw, true)
+}
+
+// VerifyAnyAudience is Verify without the audience check: any token from a
+// configured issuer passes. Only for introspection, never for minting.
+func (v *issuerVerifier) VerifyAnyAudience(ctx context.Context, raw string) (*oidc.IDToken, error) {
+	return v.verify(ctx, raw, false)
+}
+
+func (v *issuerVerifier) verify(ctx context.Context, raw string, checkAudience bool) (*oidc.IDToken, error) {
+	if checkAudience {
+		if idTok, ok := v.cache.get(raw, time.Now()); ok {
+			return idTok, nil
+		}
+	}
+	iss, err := unverifiedIssuer(raw)
+	if err != nil {
+		return nil, err
+	}
+	entry, ok := v.byIssuer[normalizeIssuer(iss)]
+	if !ok {
+		return nil, errUnknownIssuer
+	}
+	verifier, _, _ := entry.current()
+	idTok, err := verifier.Verify(ctx, raw)
+	if err != nil && isSignatureMiss(err) {
+		// unknown kid even after go-oidc's own refetch: rebuild the key set
+		// once and retry before failing
+		if rerr := entry.refresh(v.ctx, true); rerr != nil {
+			log.Printf("keyset refresh %s after signature miss: %v", entry.issuer, rerr)
+		}
+		if retry, _, _ := entry.current(); retry != verifier {
+			idTok, err = retry.Verify(ctx, raw)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := checkTokenTimes(idTok, time.Now(), v.skew); err != nil {
+		return nil, err
+	}
+	if !checkAudience {
+		return idTok, nil
+	}
+	for _, aud := range idTok.Audience {
+		if slices.Contains(entry.clientIDs, aud) {
+			v.cache.put(raw, idTok, time.Now())
+			return idTok, nil
+		}
+	}
+	return nil, errWrongAudience
+}
+
+// routeAudiences narrows, per route, which of the configured audiences a
+// verified token may carry; routes not listed accept any of them.
+type routeAudiences map[string]map[string]bool
+
+// audienceRoutes are the routes that verify the caller's ID token against
+// the configured client ids, so the only ones ROUTE_AUDIENCES can narrow.
+var audienceRoutes = map[string]bool{
+	"/whoami": true, "/token": true, "/token/introspect": true, "/token/batch": true, "/token/stream": true,
+	"/ratelimit": true, "/idtoken": true, "/ticket": true, "/userinfo": true,
+}
+
+func (ra routeAudiences) allows(route string, aud []string) bool {
+	allowed, ok := ra[route]
+	if !ok {
+		return true
+	}
+	for _, a := range aud {
+		if allowed[a] {
+			return true
+		}
+	}
+	return false
+}
+
+// isSignatureMiss reports whether go-oidc found no key that verifies the
+// token's signature.
+func isSignatureMiss(err error) bool {
+	return strings.Contains(err.Error(), "failed to verify signature")
+}
+
+// checkTokenTimes validates exp, nbf and iat against now, each allowed to be
+// off by up to skew in the client's favor.
+func checkTokenTimes(idTok *oidc.IDToken, now time.Time, skew time.Duration) error {
+	if now.Add(-skew).After(idTok.Expiry) {
+		return fmt.Errorf("%w at %s", errTokenExpired, idTok.Expiry.UTC().Format(time.RFC3339))
+	}
+	var c struct {
+		NotBefore *float64 `json:"nbf"`
+	}
+	if err := idTok.Claims(&c); err != nil {
+		return err
+	}
+	if c.NotBefore != nil {
+		nbf := time.Unix(int64(*c.NotBefore), 0)
+		if now.Add(skew).Before(nbf) {
+			return fmt.Errorf("%w before nbf %s", errTokenNotYetUsed, nbf.UTC().Format(time.RFC3339))
+		}
+	}
+	if !idTok.IssuedAt.IsZero() && now.Add(skew).Before(idTok.IssuedAt) {
+		return fmt.Errorf("%w before iat %s", errTokenNotYetUsed, idTok.IssuedAt.UTC().Format(time.RFC3339))
+	}
+	return nil
+}
+
+// normalizeIssuer maps Google's scheme-less issuer onto its canonical form.
+func normalizeIssuer(iss string) string {
+	if iss == "accounts.google.com" {
+		return googleIssuer
+	}
+	return strings.TrimSuffix(iss, "/")
+}
+
+// unverifiedIssuer reads iss from the JWT payload without checking the
+// signature; it is only used to pick the verifier.
+func unverifiedIssuer(raw string) (string, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return "", errors.New("malformed jwt")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", fmt.Errorf("malformed jwt payload: %w", err)
+	}
+	var c struct {
+		Issuer string `json:"iss"`
+	}
+	if err := json.Unmarshal(payload, &c); err != nil {
+		return "", fmt.Errorf("malformed jwt payload: %w", err)
+	}
+	return c.Issuer, nil
+}
+
+// prefetchJWKSToken is a well-formed JWS with an unknown kid; verifying it
+// forces the key set to fetch the provider's JWKS.
+const prefetchJWKSToken = "eyJhbGciOiJSUzI1NiIsImtpZCI6ImJyb2tlci1wcmVmZXRjaCJ9.e30.AA"
+
+// prefetch fetches every provider's JWKS (with bounded exponential backoff)
+// and warms the verifier's key cache so the first real verification doesn't
+// pay for it.
+func (v *issuerVerifier) prefetch(ctx context.Context, attempts int) {
+	for iss, entry := range v.byIssuer {
+		backoff := 500 * time.Millisecond
+		for attempt := 1; ; attempt++ {
+			_, keySet, jwksURL := entry.current()
+			n, err := countJWKS(ctx, jwksURL)
+			if err == nil {
+				_, _ = keySet.VerifySignature(ctx, prefetchJWKSToken)
+				log.Printf("jwks prefetch %s: %d keys", iss, n)
+				break
+			}
+			if attempt >= attempts || ctx.Err() != nil {
+				log.Printf("jwks prefetch %s failed after %d attempts: %v", iss, attempt, err)
+				break
+			}
+			log.Printf("jwks prefetch %s attempt %d: %v; retrying in %s", iss, attempt, err, backoff)
+			select {
+			case <-ctx.Done():
+			case <-time.After(backoff):
+			}
+			backoff = min(backoff*2, 10*time.Second)
+		}
+	}
+}
+
+func countJWKS(ctx context.Context, jwksURL string) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, jwksURL, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := clientFrom(ctx).Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("jwks status %d", resp.StatusCode)
+	}
+	var set struct {
+		Keys []json.RawMessage `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return 0, err
+	}
+	return len(set.Keys), nil
+}
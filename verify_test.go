@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+)
+
+// testIssuer is an OIDC provider on httptest: discovery plus JWKS. The key
+// set is served at jwksPath so tests can move it.
+type testIssuer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	signer   *testSigner
+	jwksPath string
+}
+
+func newTestIssuer(t testing.TB) *testIssuer {
+	t.Helper()
+	iss := &testIssuer{signer: newTestSigner(t, "k1"), jwksPath: "/jwks"}
+	iss.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		iss.mu.Lock()
+		defer iss.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			_ = json.NewEncoder(w).Encode(map[string]any{
+				"issuer":                                iss.URL,
+				"jwks_uri":                              iss.URL + iss.jwksPath,
+				"id_token_signing_alg_values_supported": []string{"RS256"},
+			})
+		case iss.jwksPath:
+			_ = json.NewEncoder(w).Encode(iss.signer.jwks())
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(iss.Close)
+	return iss
+}
+
+// token signs claims for this issuer on top of a valid default token.
+func (iss *testIssuer) token(t testing.TB, overrides map[string]any) string {
+	iss.mu.Lock()
+	s := iss.signer
+	iss.mu.Unlock()
+	c := idClaims(overrides)
+	if _, ok := overrides["iss"]; !ok {
+		c["iss"] = iss.URL
+	}
+	return s.sign(t, c)
+}
+
+// rotate moves the key set to a new URL with a new key; the old URL 404s.
+func (iss *testIssuer) rotate(t *testing.T, kid, path string) {
+	iss.mu.Lock()
+	defer iss.mu.Unlock()
+	iss.signer, iss.jwksPath = newTestSigner(t, kid), path
+}
+
+func TestIssuerVerifierRoutesByIssuer(t *testing.T) {
+	a, b := newTestIssuer(t), newTestIssuer(t)
+	v, err := newIssuerVerifier(context.Background(), []providerConfig{
+		{Issuer: a.URL, ClientIDs: []string{testClientID}},
+		{Issuer: b.URL, ClientIDs: []string{"b-client"}},
+	}, 30*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if _, err := v.Verify(ctx, a.token(t, nil)); err != nil {
+		t.Errorf("issuer a: %v", err)
+	}
+	if _, err := v.Verify(ctx, b.token(t, map[string]any{"aud": "b-client"})); err != nil {
+		t.Errorf("issuer b: %v", err)
+	}
+	// b's audience only counts for b
+	if _, err := v.Verify(ctx, a.token(t, map[string]any{"aud": "b-client"})); !errors.Is(err, errWrongAudience) {
+		t.Errorf("b's audience on a: err = %v, want errWrongAudience", err)
+	}
+	// a token signed by a but claiming b's issuer fails b's signature check
+	forged := a.token(t, map[string]any{"iss": b.URL, "aud": "b-client"})
+	if _, err := v.Verify(ctx, forged); err == nil {
+		t.Error("token signed by a verified as b")
+	}
+	if _, err := v.Verify(ctx, a.token(t, map[string]any{"iss": "https://elsewhere.test"})); !errors.Is(err, errUnknownIssuer) {
+		t.Errorf("unknown issuer: err = %v, want errUnknownIssuer", err)
+	}
+}
+
+func TestIssuerVerifierRefreshesOnSignatureMiss(t *testing.T) {
+	iss := newTestIssuer(t)
+	v, err := newIssuerVerifier(context.Background(), []providerConfig{{Issuer: iss.URL, ClientIDs: []string{testClientID}}}, 30*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if _, err := v.Verify(ctx, iss.token(t, nil)); err != nil {
+		t.Fatalf("before rotation: %v", err)
+	}
+
+	// New key at a new jwks_uri: only re-discovery finds it.
+	iss.rotate(t, "k2", "/jwks2")
+	v.byIssuer[iss.URL].mu.Lock()
+	v.byIssuer[iss.URL].lastRefresh = time.Now().Add(-time.Minute)
+	v.byIssuer[iss.URL].mu.Unlock()
+	if _, err := v.Verify(ctx, iss.token(t, nil)); err != nil {
+		t.Fatalf("after rotation: %v", err)
+	}
+
+	// A second miss right away is not allowed to force another refresh.
+	iss.rotate(t, "k3", "/jwks3")
+	if _, err := v.Verify(ctx, iss.token(t, nil)); err == nil {
+		t.Fatal("forced refresh ran again within minForcedRefresh")
+	}
+}
+
+func TestVerifyCacheServesUntilExpiry(t *testing.T) {
+	iss := newTestIssuer(t)
+	v, err := newIssuerVerifier(context.Background(), []providerConfig{{Issuer: iss.URL, ClientIDs: []string{testClientID}}}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.cache = newVerifyCache(8)
+	raw := iss.token(t, nil)
+	if _, err := v.Verify(context.Background(), raw); err != nil {
+		t.Fatal(err)
+	}
+	// with the issuer gone, only the cache can verify
+	iss.Close()
+	v.byIssuer[iss.URL].verifier = nil
+	if _, err := v.Verify(context.Background(), raw); err != nil {
+		t.Fatalf("cached verify: %v", err)
+	}
+	if _, ok := v.cache.get(raw, time.Now().Add(2*time.Hour)); ok {
+		t.Error("cache served an expired token")
+	}
+}
+
+// parsedToken verifies claims signed by a throwaway key, checking only the
+// signature, so checkTokenTimes sees the raw time claims.
+func parsedToken(t *testing.T, claims map[string]any) *oidc.IDToken {
+	t.Helper()
+	s := newTestSigner(t, "k1")
+	keys := &oidc.StaticKeySet{PublicKeys: []crypto.PublicKey{&s.key.PublicKey}}
+	tok, err := oidc.NewVerifier(testIssuerURL, keys, &oidc.Config{SkipClientIDCheck: true, SkipExpiryCheck: true}).
+		Verify(context.Background(), s.sign(t, claims))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tok
+}
+
+func TestCheckTokenTimes(t *testing.T) {
+	now := time.Now()
+	skew := 30 * time.Second
+	tests := []struct {
+		name    string
+		claims  map[string]any
+		wantErr error
+	}{
+		{"valid", nil, nil},
+		{"nbf within skew", map[string]any{"nbf": now.Add(20 * time.Second).Unix()}, nil},
+		{"nbf beyond skew", map[string]any{"nbf": now.Add(time.Minute).Unix()}, errTokenNotYetUsed},
+		{"iat beyond skew", map[string]any{"iat": now.Add(time.Minute).Unix()}, errTokenNotYetUsed},
+		{"expired within skew", map[string]any{"exp": now.Add(-20 * time.Second).Unix()}, nil},
+		{"expired beyond skew", map[string]any{"exp": now.Add(-time.Minute).Unix(), "iat": now.Add(-time.Hour).Unix()}, errTokenExpired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkTokenTimes(parsedToken(t, idClaims(tt.claims)), now, skew)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("err = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// TestNbfSkew runs nbf through the full verifier: go-oidc's own nbf check
+// allows a fixed 5m, so a 1m-ahead nbf only fails if OIDC_SKEW_SECONDS is
+// really what's applied.
+func TestNbfSkew(t *testing.T) {
+	iss := newTestIssuer(t)
+	v, err := newIssuerVerifier(context.Background(), []providerConfig{{Issuer: iss.URL, ClientIDs: []string{testClientID}}}, 30*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	ctx := context.Background()
+	if _, err := v.Verify(ctx, iss.token(t, map[string]any{"nbf": now.Add(20 * time.Second).Unix()})); err != nil {
+		t.Errorf("nbf 20s ahead, 30s skew: %v", err)
+	}
+	if _, err := v.Verify(ctx, iss.token(t, map[string]any{"nbf": now.Add(time.Minute).Unix()})); !errors.Is(err, errTokenNotYetUsed) {
+		t.Errorf("nbf 1m ahead, 30s skew: err = %v, want errTokenNotYetUsed", err)
+	}
+}
+
+func TestClockSkewErrorCodes(t *testing.T) {
+	iss := newTestIssuer(t)
+	v, err := newIssuerVerifier(context.Background(), []providerConfig{{Issuer: iss.URL, ClientIDs: []string{testClientID}}}, 30*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServer(t, testConfig(t, nil), v, &fakeMinter{}, nil)
+	now := time.Now()
+	for _, tt := range []struct {
+		name     string
+		raw      string
+		wantCode errorCode
+	}{
+		{"expired beyond skew", iss.token(t, map[string]any{"exp": now.Add(-time.Minute).Unix(), "iat": now.Add(-time.Hour).Unix()}), codeIDTokenExpired},
+		{"issued in the future", iss.token(t, map[string]any{"iat": now.Add(5 * time.Minute).Unix()}), codeIDTokenNotYetValid},
+		{"bad signature", newTestSigner(t, "k1").sign(t, idClaims(map[string]any{"iss": iss.URL})), codeInvalidToken},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/token", nil)
+		req.Header.Set("Authorization", "Bearer "+tt.raw)
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		var body struct {
+			Error string    `json:"error"`
+			Code  errorCode `json:"code"`
+		}
+		_ = json.Unmarshal(rec.Body.Bytes(), &body)
+		if rec.Code != http.StatusUnauthorized || body.Code != tt.wantCode {
+			t.Errorf("%s: %d %s, want 401 %s", tt.name, rec.Code, rec.Body, tt.wantCode)
+		}
+		if tt.wantCode != codeInvalidToken && !strings.Contains(body.Error, "server time") {
+			t.Errorf("%s: error %q doesn't give the server time", tt.name, body.Error)
+		}
+	}
+}
+
+// BenchmarkVerify compares a full signature check with VERIFY_CACHE_SIZE
+// serving the same token again.
+func BenchmarkVerify(b *testing.B) {
+	for _, size := range []int{0, 1024} {
+		name := "uncached"
+		if size > 0 {
+			name = "cached"
+		}
+		b.Run(name, func(b *testing.B) {
+			iss := newTestIssuer(b)
+			v, err := newIssuerVerifier(context.Background(), []providerConfig{{Issuer: iss.URL, ClientIDs: []string{testClientID}}}, 0)
+			if err != nil {
+				b.Fatal(err)
+			}
+			v.cache = newVerifyCache(size)
+			raw := iss.token(b, nil)
+			ctx := context.Background()
+			if _, err := v.Verify(ctx, raw); err != nil {
+				b.Fatal(err)
+			}
+			b.ResetTimer()
+			for range b.N {
+				if _, err := v.Verify(ctx, raw); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+)
+
+// ------- verified token cache -------
+
+// verifyCache remembers ID tokens that passed full verification, keyed by
+// sha256 of the raw token, so a client reusing one token across many calls
+// pays for the signature check once. Entries are served only until the
+// token's exp and the least recently used entry is evicted at max. Tokens
+// whose signing key is later rotated out stay valid here until exp, just as
+// if the client had been issued a fresh access token then.
+type verifyCache struct {
+	mu    sync.Mutex
+	max   int
+	ll    *list.List // front = most recently used
+	items map[[sha256.Size]byte]*list.Element
+}
+
+type verifyCacheEntry struct {
+	key [sha256.Size]byte
+	tok *oidc.IDToken
+}
+
+// newVerifyCache returns nil (caching off) when max is not positive.
+func newVerifyCache(max int) *verifyCache {
+	if max <= 0 {
+		return nil
+	}
+	return &verifyCache{max: max, ll: list.New(), items: make(map[[sha256.Size]byte]*list.Element)}
+}
+
+func (c *verifyCache) get(raw string, now time.Time) (*oidc.IDToken, bool) {
+	if c == nil {
+		return nil, false
+	}
+	key := sha256.Sum256([]byte(raw))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		verifyCacheLookups.WithLabelValues("miss").Inc()
+		return nil, false
+	}
+	e := el.Value.(*verifyCacheEntry)
+	if !now.Before(e.tok.Expiry) {
+		c.ll.Remove(el)
+		delete(c.items, key)
+		verifyCacheLookups.WithLabelValues("miss").Inc()
+		return nil, false
+	}
+	c.ll.MoveToFront(el)
+	verifyCacheLookups.WithLabelValues("hit").Inc()
+	return e.tok, true
+}
+
+func (c *verifyCache) put(raw string, tok *oidc.IDToken, now time.Time) {
+	if c == nil || !now.Before(tok.Expiry) {
+		return
+	}
+	key := sha256.Sum256([]byte(raw))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		c.ll.MoveToFront(el)
+		return
+	}
+	c.items[key] = c.ll.PushFront(&verifyCacheEntry{key: key, tok: tok})
+	for c.ll.Len() > c.max {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.items, oldest.Value.(*verifyCacheEntry).key)
+	}
+}
@@ -0,0 +1,25 @@
+package main
+
+import "runtime"
+
+// ------- build metadata -------
+
+// Set at build time, e.g.
+//
+//	go build -ldflags "-X main.version=v1.4.0 -X main.commit=$(git rev-parse HEAD) -X main.buildTime=$(date -u +%FT%TZ)"
+var (
+	version   = "dev"
+	commit    = "dev"
+	buildTime = "dev"
+)
+
+type versionResp struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildTime string `json:"build_time"`
+	GoVersion string `json:"go_version"`
+}
+
+func buildInfo() versionResp {
+	return versionResp{Version: version, Commit: commit, BuildTime: buildTime, GoVersion: runtime.Version()}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"log"
+	"math"
+	"time"
+)
+
+// ------- enforcement warmup -------
+
+// enforcementWarmup loosens limits right after startup, when every limiter
+// is fresh: they start at factor× and tighten linearly to 1× over dur. A nil
+// warmup is always at 1×.
+type enforcementWarmup struct {
+	start  time.Time
+	dur    time.Duration
+	factor float64
+}
+
+func newEnforcementWarmup(dur time.Duration, factor float64) *enforcementWarmup {
+	if dur <= 0 || factor <= 1 {
+		return nil
+	}
+	w := &enforcementWarmup{start: time.Now(), dur: dur, factor: factor}
+	time.AfterFunc(dur, func() {
+		log.Printf("enforcement warmup ended after %s; full rate limits in effect", dur)
+	})
+	return w
+}
+
+// scale is the multiplier on limits at now, 1 once warmup is over.
+func (w *enforcementWarmup) scale(now time.Time) float64 {
+	if w == nil {
+		return 1
+	}
+	elapsed := now.Sub(w.start)
+	if elapsed >= w.dur {
+		return 1
+	}
+	return 1 + (w.factor-1)*(1-float64(elapsed)/float64(w.dur))
+}
+
+func scaleBurst(burst int, s float64) int {
+	return int(math.Ceil(float64(burst) * s))
+}
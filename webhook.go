@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ------- issuance webhook -------
+
+// issuanceEvent is the body POSTed to ISSUANCE_WEBHOOK_URL for each minted
+// token. It never carries the token itself.
+type issuanceEvent struct {
+	Event     string   `json:"event"`
+	Time      string   `json:"time"`
+	RequestID string   `json:"request_id"`
+	Subject   string   `json:"sub"`
+	Email     string   `json:"email,omitempty"`
+	IP        string   `json:"ip"`
+	Scopes    []string `json:"scopes"`
+	Resource  string   `json:"resource,omitempty"`
+}
+
+func newIssuanceEvent(requestID string, rec auditRecord) issuanceEvent {
+	return issuanceEvent{
+		Event:     rec.Event,
+		Time:      rec.Time,
+		RequestID: requestID,
+		Subject:   rec.Subject,
+		Email:     rec.Email,
+		IP:        rec.IP,
+		Scopes:    strings.Fields(rec.Scope),
+		Resource:  rec.Resource,
+	}
+}
+
+// issuanceWebhook delivers events from a single background sender so a slow
+// or dead receiver never stalls the request path. A full queue drops events
+// (counted); failed deliveries are retried a bounded number of times.
+type issuanceWebhook struct {
+	url     string
+	key     []byte
+	client  *http.Client
+	retries int
+	backoff time.Duration
+
+	mu     sync.RWMutex
+	closed bool
+	ch     chan issuanceEvent
+	done   chan struct{}
+}
+
+func newIssuanceWebhook(url string, key []byte, bufSize, retries int, timeout time.Duration) *issuanceWebhook {
+	if bufSize < 1 {
+		bufSize = 1
+	}
+	h := &issuanceWebhook{
+		url:     url,
+		key:     key,
+		client:  &http.Client{Timeout: timeout},
+		retries: retries,
+		backoff: time.Second,
+		ch:      make(chan issuanceEvent, bufSize),
+		done:    make(chan struct{}),
+	}
+	go h.run()
+	return h
+}
+
+// send queues ev; it is a no-op on a nil or closed webhook.
+func (h *issuanceWebhook) send(ev issuanceEvent) {
+	if h == nil {
+		return
+	}
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if h.closed {
+		return
+	}
+	select {
+	case h.ch <- ev:
+	default:
+		webhookEvents.WithLabelValues("dropped").Inc()
+	}
+}
+
+func (h *issuanceWebhook) run() {
+	defer close(h.done)
+	for ev := range h.ch {
+		body, err := json.Marshal(ev)
+		if err != nil {
+			log.Printf("issuance webhook: %v", err)
+			continue
+		}
+		if err := h.deliver(body); err != nil {
+			webhookEvents.WithLabelValues("failed").Inc()
+			log.Printf("issuance webhook: giving up on request_id=%s: %v", ev.RequestID, err)
+			continue
+		}
+		webhookEvents.WithLabelValues("delivered").Inc()
+	}
+}
+
+// deliver POSTs body, retrying network errors, 5xx and 429 with exponential
+// backoff. Other statuses are final.
+func (h *issuanceWebhook) deliver(body []byte) error {
+	mac := hmac.New(sha256.New, h.key)
+	mac.Write(body)
+	sig := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	for attempt := 0; ; attempt++ {
+		retry, err := h.post(body, sig)
+		if err == nil || !retry || attempt >= h.retries {
+			return err
+		}
+		time.Sleep(h.backoff << attempt)
+	}
+}
+
+func (h *issuanceWebhook) post(body []byte, sig string) (retry bool, err error) {
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, h.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Tokenbroker-Signature", sig)
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		return false, nil
+	}
+	retry = resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+	return retry, fmt.Errorf("status %d", resp.StatusCode)
+}
+
+// close stops accepting events and waits up to grace for the queue to
+// drain; whatever is still queued after that is lost.
+func (h *issuanceWebhook) close(grace time.Duration) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	if h.closed {
+		h.mu.Unlock()
+		return
+	}
+	h.closed = true
+	close(h.ch)
+	h.mu.Unlock()
+	select {
+	case <-h.done:
+	case <-time.After(grace):
+		log.Printf("issuance webhook: %d events undelivered at shutdown", len(h.ch))
+	}
+}